@@ -0,0 +1,273 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// The aggregate functions that can be computed by the network.
+const (
+	aggAverage = "avg"
+	aggSum     = "sum"
+	aggCount   = "count"
+	aggMin     = "min"
+	aggMax     = "max"
+)
+
+// aggregateMessage is a share of a node's push-sum state, or its current
+// extreme value for min/max propagation.
+type aggregateMessage struct {
+	sum    float64
+	weight float64
+}
+
+// aggregateState is the aggregation state held by each node.
+type aggregateState struct {
+	value  float64               // The initial value of the node.
+	sum    float64               // The push-sum sum, or the current extreme for min/max.
+	weight float64               // The push-sum weight.
+	inbox  chan aggregateMessage // Shares received from other nodes in the current round.
+	lock   sync.Mutex            // The mutex to guard sum and weight while sending and receiving.
+}
+
+// aggregateRound holds the estimation error across nodes after a round.
+type aggregateRound struct {
+	max_error  float64
+	mean_error float64
+}
+
+// AggregateResult holds the measurements of an aggregation run.
+type AggregateResult struct {
+	duration  time.Duration
+	truth     float64          // The exact value of the aggregate.
+	estimates []float64        // The final estimate of each node.
+	rounds    []aggregateRound // The estimation error after each round.
+	converged bool             // Whether the error fell below the tolerance.
+}
+
+// estimate returns the node's current estimate of the aggregate.
+func (a *aggregateState) estimate(function string) float64 {
+	switch function {
+	case aggMin, aggMax:
+		return a.sum
+	default:
+		return a.sum / a.weight
+	}
+}
+
+// combine merges a received message into the node's state.
+func (a *aggregateState) combine(function string, msg aggregateMessage) {
+	switch function {
+	case aggMin:
+		a.sum = math.Min(a.sum, msg.sum)
+	case aggMax:
+		a.sum = math.Max(a.sum, msg.sum)
+	default:
+		a.sum += msg.sum
+		a.weight += msg.weight
+	}
+}
+
+// relative_error returns how far estimate is from truth, relative to truth
+// when it is not zero.
+func relative_error(estimate float64, truth float64) float64 {
+	if math.IsNaN(estimate) || math.IsInf(estimate, 0) {
+		return math.Inf(1)
+	}
+
+	diff := math.Abs(estimate - truth)
+	if truth != 0 {
+		diff /= math.Abs(truth)
+	}
+
+	return diff
+}
+
+// init_aggregate sets the initial push-sum state of the node. For the average,
+// every node starts with weight 1. For the sum, only the first node has a
+// weight, so the sums converge to the total instead. Counting the nodes is a
+// sum where every value is 1.
+func (n *Node) init_aggregate(function string, value float64) {
+	n.agg = aggregateState{
+		value:  value,
+		sum:    value,
+		weight: 0,
+		inbox:  make(chan aggregateMessage, 1000),
+	}
+
+	switch function {
+	case aggAverage:
+		n.agg.weight = 1
+	case aggCount:
+		n.agg.value = 1
+		n.agg.sum = 1
+		fallthrough
+	case aggSum:
+		if n.node_pos == 0 {
+			n.agg.weight = 1
+		}
+	}
+}
+
+// send_aggregate sends the node's share to a random peer. For push-sum, the
+// node keeps half of its sum and weight, and sends the other half.
+func (n *Node) send_aggregate(function string, node_num int) {
+	rand_pos := n.select_peer(node_num)
+	if rand_pos < 0 {
+		return
+	}
+
+	n.agg.lock.Lock()
+	msg := aggregateMessage{n.agg.sum, n.agg.weight}
+	if function != aggMin && function != aggMax {
+		msg.sum /= 2
+		msg.weight /= 2
+		n.agg.sum -= msg.sum
+		n.agg.weight -= msg.weight
+	}
+	n.agg.lock.Unlock()
+
+	n.log.debug("send share", "to", rand_pos, "sum", msg.sum, "weight", msg.weight)
+	n.network.nodes[rand_pos].agg.inbox <- msg
+}
+
+// query_aggregate repeatedly reads shares from the inbox until the phase is
+// stopped, and then combines whatever is left in the buffer. It is only marked
+// done once stopped, so that no share is lost.
+func (n *Node) query_aggregate(function string) {
+	defer n.network.w_phase.Done()
+
+	for {
+		select {
+		case msg := <-n.agg.inbox:
+			n.combine_aggregate(function, msg)
+		case <-n.stop_phase:
+			for {
+				select {
+				case msg := <-n.agg.inbox:
+					n.combine_aggregate(function, msg)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// combine_aggregate merges msg into the node's state. The node's own send may
+// run concurrently, so the state is locked.
+func (n *Node) combine_aggregate(function string, msg aggregateMessage) {
+	n.agg.lock.Lock()
+	n.agg.combine(function, msg)
+	n.agg.lock.Unlock()
+}
+
+// StartAggregate sets up a network where each node holds a value, and runs
+// leader-synchronized rounds of push-sum (average, sum, count) or extreme
+// propagation (min, max) until every node's estimate is within tolerance of
+// the exact aggregate, or max_rounds is reached.
+func StartAggregate(config gossipConfig, function string, tolerance float64, max_rounds int) (AggregateResult, error) {
+	if err := validate_aggregate(config, function, tolerance, max_rounds); err != nil {
+		return AggregateResult{}, err
+	}
+
+	// As in StartGossip, the run draws from its own sources, seeded from the
+	// seed of config.
+	seed := config.seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	rng := rand.New(rand.NewSource(seed))
+
+	node_num := config.node_num
+	network := &Network{
+		has_leader: true,
+		log:        new_logger("network"),
+	}
+
+	if config.view_size > 0 {
+		network.views = new_peer_views(node_num, config.view_size, rng)
+		network.shuffle_len = config.shuffle_len
+		if network.shuffle_len <= 0 {
+			network.shuffle_len = (config.view_size + 1) / 2
+		}
+	}
+
+	network.nodes = make([]Node, node_num)
+	for i := 0; i < node_num; i++ {
+		network.nodes[i] = Node{
+			node_pos:   i,
+			stop_phase: make(chan struct{}),
+			network:    network,
+			log:        new_logger("node").for_node(i),
+			rng:        rand.New(rand.NewSource(rng.Int63())),
+		}
+		network.nodes[i].init_aggregate(function, rng.Float64()*100)
+	}
+
+	// Compute the exact aggregate to measure the estimation error against.
+	result := AggregateResult{}
+	for i := range network.nodes {
+		value := network.nodes[i].agg.value
+		switch {
+		case function == aggMin && (i == 0 || value < result.truth):
+			result.truth = value
+		case function == aggMax && (i == 0 || value > result.truth):
+			result.truth = value
+		case function == aggAverage:
+			result.truth += value / float64(node_num)
+		case function == aggSum || function == aggCount:
+			result.truth += value
+		}
+	}
+
+	start_time := time.Now()
+
+	for len(result.rounds) < max_rounds {
+		if network.views != nil {
+			network.run_phase(func(node *Node) {
+				shuffle(network.views, node.node_pos, network.shuffle_len, node.rng)
+			})
+		}
+
+		// Send shares while every node collects the shares sent to it.
+		for i := range network.nodes {
+			go network.nodes[i].query_aggregate(function)
+		}
+
+		network.run_phase(func(node *Node) {
+			node.send_aggregate(function, node_num)
+		})
+
+		// Stop the queries once every share has been sent.
+		network.w_phase.Add(node_num)
+		for i := range network.nodes {
+			network.nodes[i].stop_phase <- struct{}{}
+		}
+		network.w_phase.Wait()
+
+		round := aggregateRound{}
+		for i := range network.nodes {
+			err := relative_error(network.nodes[i].agg.estimate(function), result.truth)
+			round.mean_error += err / float64(node_num)
+			round.max_error = math.Max(round.max_error, err)
+		}
+		result.rounds = append(result.rounds, round)
+		network.log.debug("round", "round", len(result.rounds), "max error", round.max_error, "mean error", round.mean_error)
+
+		if round.max_error <= tolerance {
+			result.converged = true
+			break
+		}
+	}
+
+	result.duration = time.Since(start_time)
+	result.estimates = make([]float64, node_num)
+	for i := range network.nodes {
+		result.estimates[i] = network.nodes[i].agg.estimate(function)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+// TestAggregateSeed checks that the node values are drawn from the seed, so
+// runs with the same seed compute the same aggregate.
+func TestAggregateSeed(t *testing.T) {
+	truths := map[int64]float64{}
+	for _, seed := range []int64{1, 1, 2} {
+		config := gossipConfig{node_num: testNodes, seed: seed}
+
+		result, err := StartAggregate(config, aggMax, 0.001, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.converged {
+			t.Errorf("seed %d: did not converge in %d rounds", seed, len(result.rounds))
+		}
+
+		if truth, ok := truths[seed]; ok && truth != result.truth {
+			t.Errorf("seed %d: got a maximum of %g, then %g", seed, truth, result.truth)
+		}
+		truths[seed] = result.truth
+	}
+
+	if truths[1] == truths[2] {
+		t.Errorf("seeds 1 and 2 both got a maximum of %g", truths[1])
+	}
+}
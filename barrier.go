@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// barrierLog is the logger for barrier entries.
+var barrierLog = new_logger("barrier")
+
+// barrierMissingShown is the most missing participants listed in a timeout
+// error.
+const barrierMissingShown = 20
+
+// Barrier is a reusable cyclic barrier. Each participant has an id, and calls
+// Await once per generation. Once every participant of the generation has
+// arrived, they are all released together, and the barrier moves on to the
+// next generation.
+//
+// A barrier can be broken, either because a waiter's context is done or
+// because a generation took longer than the timeout. All current and future
+// waiters are then released with an error, so no participant is left blocked.
+//
+// Participants can join or leave between generations, for example when a node
+// crashes. A participant that leaves during a generation is no longer waited
+// for, which may complete the generation.
+type Barrier struct {
+	members    []bool        // Whether each id is a participant of the current generation.
+	parties    int           // The number of participants in the current generation.
+	joining    []int         // The participants joining from the next generation.
+	arrived    []uint64      // The generation + 1 in which each id last arrived.
+	count      int           // The number of participants that arrived in the current generation.
+	generation uint64        // The current generation, starting from 0.
+	release    chan struct{} // Closed when the current generation completes or the barrier breaks.
+	broken     error         // Why the barrier broke, or nil.
+	timeout    time.Duration // How long a generation may take from its first arrival, or 0.
+	timer      *time.Timer   // Fires when the current generation times out.
+	lock       sync.Mutex    // The mutex to guard all of the above.
+}
+
+// BarrierTimeoutError is returned by Await when a generation did not complete
+// in time. It lists the participants that never arrived.
+type BarrierTimeoutError struct {
+	Generation uint64
+	Timeout    time.Duration
+	Missing    []int
+}
+
+func (e *BarrierTimeoutError) Error() string {
+	missing := e.Missing
+	more := ""
+	if len(missing) > barrierMissingShown {
+		more = fmt.Sprintf(" and %d more", len(missing)-barrierMissingShown)
+		missing = missing[:barrierMissingShown]
+	}
+
+	return fmt.Sprintf("barrier generation %d timed out after %v waiting for participants %v%s",
+		e.Generation, e.Timeout, missing, more)
+}
+
+// NewBarrier creates a barrier for the participants 0 to parties-1. If timeout
+// is not 0, a generation that is not complete timeout after its first arrival
+// breaks the barrier.
+func NewBarrier(parties int, timeout time.Duration) *Barrier {
+	b := &Barrier{
+		members: make([]bool, parties),
+		parties: parties,
+		arrived: make([]uint64, parties),
+		release: make(chan struct{}),
+		timeout: timeout,
+	}
+
+	for id := range b.members {
+		b.members[id] = true
+	}
+
+	return b
+}
+
+// Generation returns the current generation.
+func (b *Barrier) Generation() uint64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.generation
+}
+
+// Await waits until every participant of the current generation has arrived,
+// and returns the generation that completed. It returns an error if the
+// barrier is broken, or if ctx is done first, in which case it breaks the
+// barrier for everyone else too.
+func (b *Barrier) Await(ctx context.Context, id int) (uint64, error) {
+	b.lock.Lock()
+	generation := b.generation
+
+	if b.broken != nil {
+		b.lock.Unlock()
+		return generation, b.broken
+	}
+	if !b.is_member(id) {
+		b.lock.Unlock()
+		return generation, fmt.Errorf("participant %d is not part of barrier generation %d", id, generation)
+	}
+	if b.has_arrived(id) {
+		b.lock.Unlock()
+		return generation, fmt.Errorf("participant %d already arrived in barrier generation %d", id, generation)
+	}
+
+	b.arrived[id] = generation + 1
+	b.count += 1
+	if barrierLog.enabled(levelTrace) {
+		barrierLog.trace("arrived", "id", id, "generation", generation, "arrived", b.count, "parties", b.parties)
+	}
+
+	if b.count == 1 && b.timeout > 0 {
+		b.timer = time.AfterFunc(b.timeout, func() { b.expire(generation) })
+	}
+	if b.count == b.parties {
+		b.advance()
+		b.lock.Unlock()
+		return generation, nil
+	}
+
+	release := b.release
+	b.lock.Unlock()
+
+	select {
+	case <-release:
+	case <-ctx.Done():
+		b.Break(ctx.Err())
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.generation > generation {
+		return generation, nil
+	}
+
+	return generation, b.broken
+}
+
+// Join adds a participant. If a generation is in progress, the participant
+// joins from the next one.
+func (b *Barrier) Join(id int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.count == 0 {
+		b.add_member(id)
+	} else {
+		b.joining = append(b.joining, id)
+	}
+}
+
+// is_member returns whether id is a participant. The lock must be held.
+func (b *Barrier) is_member(id int) bool {
+	return id >= 0 && id < len(b.members) && b.members[id]
+}
+
+// has_arrived returns whether id arrived in the current generation. The lock
+// must be held.
+func (b *Barrier) has_arrived(id int) bool {
+	return b.arrived[id] == b.generation+1
+}
+
+// add_member makes id a participant. The lock must be held.
+func (b *Barrier) add_member(id int) {
+	if b.is_member(id) || id < 0 {
+		return
+	}
+
+	for id >= len(b.members) {
+		b.members = append(b.members, false)
+		b.arrived = append(b.arrived, 0)
+	}
+	b.members[id] = true
+	b.parties += 1
+}
+
+// Leave removes a participant. The current generation no longer waits for it,
+// and completes if every other participant has already arrived.
+func (b *Barrier) Leave(id int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if !b.is_member(id) {
+		return
+	}
+
+	b.members[id] = false
+	b.parties -= 1
+	if b.has_arrived(id) {
+		b.arrived[id] = 0
+		b.count -= 1
+	}
+	barrierLog.debug("left", "id", id, "generation", b.generation, "parties", b.parties)
+
+	if b.count > 0 && b.count == b.parties && b.broken == nil {
+		b.advance()
+	}
+}
+
+// Break breaks the barrier with err, releasing all waiters. It does nothing
+// if the barrier is already broken.
+func (b *Barrier) Break(err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.break_locked(err)
+}
+
+// break_locked breaks the barrier. The lock must be held.
+func (b *Barrier) break_locked(err error) {
+	if b.broken != nil {
+		return
+	}
+
+	barrierLog.debug("broken", "generation", b.generation, "error", err)
+	b.broken = fmt.Errorf("barrier broken in generation %d: %w", b.generation, err)
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	close(b.release)
+}
+
+// advance completes the current generation, releasing its waiters, and starts
+// the next one with any joining participants. The lock must be held.
+func (b *Barrier) advance() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+
+	for _, id := range b.joining {
+		b.add_member(id)
+	}
+	b.joining = nil
+
+	barrierLog.trace("release", "generation", b.generation, "parties", b.count)
+	b.generation += 1
+	b.count = 0
+	close(b.release)
+	b.release = make(chan struct{})
+}
+
+// expire breaks the barrier if generation is still in progress, listing the
+// participants that have not arrived.
+func (b *Barrier) expire(generation uint64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.generation != generation || b.broken != nil {
+		return
+	}
+
+	missing := []int{}
+	for id := range b.members {
+		if b.members[id] && !b.has_arrived(id) {
+			missing = append(missing, id)
+		}
+	}
+
+	err := &BarrierTimeoutError{Generation: generation, Timeout: b.timeout, Missing: missing}
+	barrierLog.warn("timeout", "generation", generation, "missing", len(missing), "error", err.Error())
+	b.break_locked(err)
+}
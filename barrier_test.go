@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestBarrierStress has many participants pass many generations, and checks
+// that nobody is released from a generation before everyone has arrived.
+func TestBarrierStress(t *testing.T) {
+	parties := 64
+	generations := 200
+	if testing.Short() {
+		generations = 20
+	}
+
+	b := NewBarrier(parties, 0)
+	arrivals := make([]int64, generations)
+
+	var w sync.WaitGroup
+	w.Add(parties)
+	for id := 0; id < parties; id++ {
+		go func(id int) {
+			defer w.Done()
+			for g := 0; g < generations; g++ {
+				atomic.AddInt64(&arrivals[g], 1)
+
+				generation, err := b.Await(context.Background(), id)
+				if err != nil {
+					t.Errorf("participant %d: %v", id, err)
+					return
+				}
+				if generation != uint64(g) {
+					t.Errorf("participant %d: released from generation %d, want %d", id, generation, g)
+					return
+				}
+				if a := atomic.LoadInt64(&arrivals[g]); a != int64(parties) {
+					t.Errorf("participant %d: released from generation %d after %d of %d arrivals", id, g, a, parties)
+					return
+				}
+			}
+		}(id)
+	}
+	w.Wait()
+
+	if g := b.Generation(); g != uint64(generations) {
+		t.Errorf("barrier is in generation %d, want %d", g, generations)
+	}
+}
+
+// TestBarrierLeave has participants leave one by one while the others keep
+// passing generations, as crashed nodes do.
+func TestBarrierLeave(t *testing.T) {
+	parties := 32
+	b := NewBarrier(parties, 0)
+
+	var w sync.WaitGroup
+	w.Add(parties)
+	for id := 0; id < parties; id++ {
+		go func(id int) {
+			defer w.Done()
+
+			// Participant id leaves after id generations, so the last one is
+			// alone for its final generations.
+			for g := 0; g < id; g++ {
+				if _, err := b.Await(context.Background(), id); err != nil {
+					t.Errorf("participant %d: %v", id, err)
+					return
+				}
+			}
+			b.Leave(id)
+		}(id)
+	}
+	w.Wait()
+
+	if g := b.Generation(); g != uint64(parties-1) {
+		t.Errorf("barrier is in generation %d, want %d", g, parties-1)
+	}
+}
+
+// TestBarrierCancel checks that a cancelled waiter breaks the barrier and
+// releases every other waiter with the cause.
+func TestBarrierCancel(t *testing.T) {
+	parties := 16
+	b := NewBarrier(parties, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	errs := make(chan error, parties)
+	for id := 0; id < parties-1; id++ {
+		go func(id int) {
+			_, err := b.Await(ctx, id)
+			errs <- err
+		}(id)
+	}
+
+	cancel()
+	for i := 0; i < parties-1; i++ {
+		if err := <-errs; !errors.Is(err, context.Canceled) {
+			t.Errorf("got %v, want context.Canceled", err)
+		}
+	}
+
+	// Later arrivals are released immediately.
+	if _, err := b.Await(context.Background(), parties-1); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
+
+// TestBarrierTimeout checks that a generation that does not complete in time
+// breaks the barrier, listing the participants that never arrived.
+func TestBarrierTimeout(t *testing.T) {
+	b := NewBarrier(4, 20*time.Millisecond)
+
+	errs := make(chan error, 2)
+	for id := 0; id < 2; id++ {
+		go func(id int) {
+			_, err := b.Await(context.Background(), id)
+			errs <- err
+		}(id)
+	}
+
+	for i := 0; i < 2; i++ {
+		err := <-errs
+
+		var timeout *BarrierTimeoutError
+		if !errors.As(err, &timeout) {
+			t.Fatalf("got %v, want *BarrierTimeoutError", err)
+		}
+		if len(timeout.Missing) != 2 || timeout.Missing[0] != 2 || timeout.Missing[1] != 3 {
+			t.Errorf("missing participants %v, want [2 3]", timeout.Missing)
+		}
+	}
+}
+
+// TestBarrierTwice checks that a participant cannot arrive twice in the same
+// generation.
+func TestBarrierTwice(t *testing.T) {
+	b := NewBarrier(2, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go b.Await(ctx, 0)
+	for {
+		b.lock.Lock()
+		count := b.count
+		b.lock.Unlock()
+		if count == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := b.Await(ctx, 0); err == nil {
+		t.Error("arrived twice in the same generation without an error")
+	}
+}
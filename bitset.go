@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"math/bits"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// engineBitset runs a synchronous network with one bit of state per node.
+const engineBitset = "bitset"
+
+// bitset is a set of nodes, one bit per node.
+type bitset []uint64
+
+// new_bitset creates an empty bitset for n nodes.
+func new_bitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+// has returns whether pos is in the set.
+func (b bitset) has(pos int) bool {
+	return b[pos/64]&(1<<uint(pos%64)) != 0
+}
+
+// set_atomic adds pos to the set. It may be called concurrently for any
+// positions.
+func (b bitset) set_atomic(pos int) {
+	word := &b[pos/64]
+	bit := uint64(1) << uint(pos%64)
+	for {
+		old := atomic.LoadUint64(word)
+		if old&bit != 0 || atomic.CompareAndSwapUint64(word, old, old|bit) {
+			return
+		}
+	}
+}
+
+// fastRand is a splitmix64 generator. It is much cheaper than math/rand, which
+// matters when drawing a peer for each of 10^8 nodes every round.
+type fastRand struct {
+	state uint64
+}
+
+func (r *fastRand) next() uint64 {
+	r.state += 0x9e3779b97f4a7c15
+	z := r.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// intn returns a number in [0, n) for n < 2^32, by scaling instead of the
+// slower modulo.
+func (r *fastRand) intn(n int) int {
+	return int(((r.next() >> 32) * uint64(n)) >> 32)
+}
+
+// bitsetShard is a range of words of the bitsets, processed by one goroutine
+// with its own random source.
+type bitsetShard struct {
+	lo, hi int // The words of the shard, from lo to hi-1.
+	rng    fastRand
+	added  int // The nodes infected by the shard's last merge.
+}
+
+// bitsetEngine runs the rounds of a synchronous network on bitsets. Each phase
+// draws the contacts of every node into next while infected is only read, and
+// then merges next into infected in bulk, so a phase sees the state at its
+// start, like the goroutine engine. It does not record how each node was
+// infected, which would take more memory than the state itself.
+type bitsetEngine struct {
+	network  *Network
+	node_num int
+	infected bitset // The infected nodes.
+	next     bitset // The nodes infected in the current phase.
+	count    int    // The number of infected nodes.
+	shards   []bitsetShard
+	curve    []int // The number of infected nodes after each round.
+}
+
+// new_bitset_engine creates an engine for node_num nodes, of which the first
+// infected_num are infected, with one shard per CPU. Shard i draws its peers
+// from seed + i.
+func new_bitset_engine(network *Network, node_num int, infected_num int, seed int64) *bitsetEngine {
+	e := &bitsetEngine{
+		network:  network,
+		node_num: node_num,
+		infected: new_bitset(node_num),
+		next:     new_bitset(node_num),
+		count:    infected_num,
+		curve:    []int{infected_num},
+	}
+
+	for pos := 0; pos < infected_num; pos++ {
+		e.infected[pos/64] |= 1 << uint(pos%64)
+	}
+
+	words := len(e.infected)
+	shards := runtime.GOMAXPROCS(0)
+	if shards > words {
+		shards = words
+	}
+	size := (words + shards - 1) / shards
+	for lo := 0; lo < words; lo += size {
+		hi := lo + size
+		if hi > words {
+			hi = words
+		}
+		e.shards = append(e.shards, bitsetShard{lo: lo, hi: hi, rng: fastRand{uint64(seed) + uint64(len(e.shards))}})
+	}
+
+	return e
+}
+
+// run runs step on every shard in parallel, and waits for all of them.
+func (e *bitsetEngine) run(step func(s *bitsetShard)) {
+	var w sync.WaitGroup
+	w.Add(len(e.shards))
+	for i := range e.shards {
+		go func(s *bitsetShard) {
+			defer w.Done()
+			step(s)
+		}(&e.shards[i])
+	}
+	w.Wait()
+}
+
+// word_mask returns the bits of word that are nodes, since the last word may
+// be partly used.
+func (e *bitsetEngine) word_mask(word int) uint64 {
+	if rest := e.node_num - word*64; rest < 64 {
+		return (1 << uint(rest)) - 1
+	}
+
+	return ^uint64(0)
+}
+
+// select_peer returns a uniformly random node other than pos.
+func (e *bitsetEngine) select_peer(s *bitsetShard, pos int) int {
+	peer := s.rng.intn(e.node_num - 1)
+	if peer >= pos {
+		peer += 1
+	}
+
+	return peer
+}
+
+// push_step lets every infected node of the shard push to a random peer.
+func (e *bitsetEngine) push_step(s *bitsetShard) {
+	for word := s.lo; word < s.hi; word++ {
+		for set := e.infected[word]; set != 0; set &= set - 1 {
+			pos := word*64 + bits.TrailingZeros64(set)
+			e.next.set_atomic(e.select_peer(s, pos))
+		}
+	}
+}
+
+// pull_step lets every susceptible node of the shard pull from a random peer.
+// A node only ever sets its own bit, and shards own whole words, so no atomic
+// operations are needed.
+func (e *bitsetEngine) pull_step(s *bitsetShard) {
+	for word := s.lo; word < s.hi; word++ {
+		pulled := uint64(0)
+		for set := ^e.infected[word] & e.word_mask(word); set != 0; set &= set - 1 {
+			bit := bits.TrailingZeros64(set)
+			if e.infected.has(e.select_peer(s, word*64+bit)) {
+				pulled |= 1 << uint(bit)
+			}
+		}
+		e.next[word] = pulled
+	}
+}
+
+// merge_step adds the nodes infected in the phase to the shard's words of
+// infected, counts them and clears next.
+func (e *bitsetEngine) merge_step(s *bitsetShard) {
+	s.added = 0
+	for word := s.lo; word < s.hi; word++ {
+		s.added += bits.OnesCount64(e.next[word] &^ e.infected[word])
+		e.infected[word] |= e.next[word]
+		e.next[word] = 0
+	}
+}
+
+// phase runs a push or pull phase, and returns the number of messages sent,
+// which is one for every infected or susceptible node at its start.
+func (e *bitsetEngine) phase(name string, step func(s *bitsetShard)) int64 {
+	sent := int64(e.count)
+	if name == "pull" {
+		sent = int64(e.node_num - e.count)
+	}
+
+	e.run(step)
+	e.run(e.merge_step)
+	for i := range e.shards {
+		e.count += e.shards[i].added
+	}
+
+	return sent
+}
+
+// Gossip runs rounds until the network is fully infected, the gossip is
+// stopped or the maximum number of rounds is reached.
+func (e *bitsetEngine) Gossip() {
+	n := e.network
+
+	for {
+		if err := n.ctx.Err(); err != nil {
+			n.fail(err)
+			break
+		}
+
+		n.round += 1
+
+		if n.should_push {
+			atomic.AddInt64(&n.pushes, e.phase("push", e.push_step))
+		}
+		if n.should_pull {
+			// Every node that pulled the rumor got it in a reply.
+			before := e.count
+			atomic.AddInt64(&n.pulls, e.phase("pull", e.pull_step))
+			atomic.AddInt64(&n.replies, int64(e.count-before))
+		}
+
+		n.lock.Lock()
+		n.num_infected = e.count
+		n.saturated = e.count >= e.node_num
+		n.lock.Unlock()
+		e.curve = append(e.curve, e.count)
+
+		// A round interrupted by a cancellation does not count as completed.
+		if err := n.ctx.Err(); err != nil {
+			n.fail(err)
+			break
+		}
+
+		n.notify_round(n.round)
+
+		if n.saturated {
+			break
+		}
+		if n.max_rounds > 0 && n.round >= n.max_rounds {
+			n.fail(ErrMaxRounds)
+			break
+		}
+	}
+}
+
+// start_bitset runs the gossip of config with the bitset engine. The engine
+// has no per-node state to trace, so config has no tracer, and its observer
+// may only read the network's counters.
+func start_bitset(ctx context.Context, config gossipConfig, seed int64) GossipResult {
+	node_num := config.node_num
+
+	network := &Network{
+		has_leader:   true,
+		should_push:  config.should_push,
+		should_pull:  config.should_pull,
+		num_infected: config.infected_num,
+		max_rounds:   config.max_rounds,
+		observer:     config.observer,
+		log:          new_logger("network"),
+	}
+
+	if config.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.timeout)
+		defer cancel()
+	}
+	network.ctx, network.cancel = context.WithCancel(ctx)
+	defer network.cancel()
+
+	engine := new_bitset_engine(network, node_num, config.infected_num, seed)
+	network.log.debug("bitset", "shards", len(engine.shards), "words", len(engine.infected))
+
+	stats := start_stats()
+	network.start_time = time.Now()
+	engine.Gossip()
+	duration := time.Since(network.start_time)
+	runtime_stats := stats.finish()
+
+	// The curve ends with the last round that infected a node, like the curve
+	// built from infection records.
+	curve := engine.curve
+	for len(curve) > 1 && curve[len(curve)-1] == curve[len(curve)-2] {
+		curve = curve[:len(curve)-1]
+	}
+
+	result := GossipResult{
+		duration:   duration,
+		avg_rounds: float64(len(network.round_messages)),
+		nodes:      node_num,
+		curve:      curve,
+		messages:   network.round_messages,
+		rounds:     len(network.round_messages),
+		infected:   engine.count,
+		pushes:     network.pushes,
+		pulls:      network.pulls,
+		replies:    network.replies,
+		err:        network.err,
+		stats:      runtime_stats,
+	}
+	result.converged = result.err == nil && result.infected >= node_num
+
+	return result
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// nodeClass is a kind of node in a heterogeneous network, such as a server or
+// an edge device. Nodes without a class act like a class with the defaults of
+// new_class.
+type nodeClass struct {
+	name   string
+	share  float64       // The fraction of the nodes not listed in nodes that get the class.
+	nodes  string        // The nodes that get the class, as positions and ranges such as 0-9,20.
+	delay  time.Duration // How long a node takes to process each phase.
+	fanout int           // The number of peers contacted in each phase.
+	online float64       // The probability that a node is online in a round.
+	push   bool          // Whether the nodes can push.
+	pull   bool          // Whether the nodes can pull.
+}
+
+// new_class returns a class of nodes that act like nodes without a class.
+func new_class(name string) nodeClass {
+	return nodeClass{name: name, fanout: 1, online: 1, push: true, pull: true}
+}
+
+// parse_classes parses a distribution of classes, such as
+// "server=0.8,fanout=2;edge=0.2,delay=5ms,online=0.7,push=false". Each class
+// starts with its name and share, followed by any of delay, fanout, online,
+// push and pull.
+func parse_classes(spec string) ([]nodeClass, error) {
+	classes := []nodeClass{}
+
+	for _, item := range strings.Split(spec, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		var class nodeClass
+		for i, field := range strings.Split(item, ",") {
+			kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("invalid class field %q, want key=value", field)
+			}
+			key, value := kv[0], kv[1]
+
+			if i == 0 {
+				share, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid share %q of class %s", value, key)
+				}
+				class = new_class(key)
+				class.share = share
+				continue
+			}
+
+			if err := class.set(key, value); err != nil {
+				return nil, err
+			}
+		}
+
+		classes = append(classes, class)
+	}
+
+	if len(classes) == 0 {
+		return nil, fmt.Errorf("no class in %q", spec)
+	}
+
+	return classes, nil
+}
+
+// set sets the attribute key of the class from its text value.
+func (c *nodeClass) set(key string, value string) error {
+	var err error
+	switch key {
+	case "delay":
+		c.delay, err = time.ParseDuration(value)
+	case "fanout":
+		c.fanout, err = strconv.Atoi(value)
+	case "online":
+		c.online, err = strconv.ParseFloat(value, 64)
+	case "push":
+		c.push, err = strconv.ParseBool(value)
+	case "pull":
+		c.pull, err = strconv.ParseBool(value)
+	default:
+		return fmt.Errorf("unknown attribute %q of class %s", key, c.name)
+	}
+
+	if err != nil {
+		return fmt.Errorf("invalid %s %q of class %s", key, value, c.name)
+	}
+
+	return nil
+}
+
+// classFile is the JSON format of a classes file. Attributes that are left out
+// get the defaults of new_class.
+type classFile struct {
+	Classes []struct {
+		Name   string   `json:"name"`
+		Share  float64  `json:"share"`
+		Nodes  string   `json:"nodes"`
+		Delay  string   `json:"delay"`
+		Fanout *int     `json:"fanout"`
+		Online *float64 `json:"online"`
+		Push   *bool    `json:"push"`
+		Pull   *bool    `json:"pull"`
+	} `json:"classes"`
+}
+
+// read_classes reads the classes of a JSON file, such as
+// {"classes": [{"name": "edge", "nodes": "0-9", "delay": "5ms", "online": 0.7}]}.
+func read_classes(path string) ([]nodeClass, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file classFile
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(file.Classes) == 0 {
+		return nil, fmt.Errorf("%s: no class", path)
+	}
+
+	classes := make([]nodeClass, len(file.Classes))
+	for i, f := range file.Classes {
+		c := new_class(f.Name)
+		c.share = f.Share
+		c.nodes = f.Nodes
+		if f.Delay != "" {
+			if err := c.set("delay", f.Delay); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+		}
+		if f.Fanout != nil {
+			c.fanout = *f.Fanout
+		}
+		if f.Online != nil {
+			c.online = *f.Online
+		}
+		if f.Push != nil {
+			c.push = *f.Push
+		}
+		if f.Pull != nil {
+			c.pull = *f.Pull
+		}
+		classes[i] = c
+	}
+
+	return classes, nil
+}
+
+// check_classes returns a *ConfigError for the first invalid class of a
+// network of node_num nodes, or nil. A node may be listed by one class only.
+func check_classes(classes []nodeClass, node_num int) error {
+	invalid := func(c nodeClass, reason string) error {
+		return &ConfigError{"--classes", c.name, reason, ErrInvalidOption}
+	}
+
+	names := map[string]bool{}
+	listed := map[int]bool{}
+	for _, c := range classes {
+		switch {
+		case c.name == "":
+			return invalid(c, "every class needs a name")
+		case names[c.name]:
+			return invalid(c, "class names must be unique")
+		case c.share < 0 || math.IsNaN(c.share) || math.IsInf(c.share, 0):
+			return invalid(c, "need a share of 0 or more")
+		case c.delay < 0:
+			return invalid(c, "need a delay of 0 or more")
+		case c.fanout < 1:
+			return invalid(c, "need a fanout of at least 1")
+		case !(c.online >= 0 && c.online <= 1):
+			return invalid(c, "need an online probability between 0 and 1")
+		}
+		names[c.name] = true
+
+		nodes, err := parse_node_list(c.nodes, node_num)
+		if err != nil {
+			return invalid(c, err.Error())
+		}
+		for pos := range nodes {
+			if listed[pos] {
+				return invalid(c, fmt.Sprintf("node %d is listed by another class", pos))
+			}
+			listed[pos] = true
+		}
+	}
+
+	return nil
+}
+
+// unreachable_class returns the name of the first class whose nodes can never
+// all be infected, or "". A node can be infected only while online, by a push
+// if any online node can push, or by its own pull. Nodes without a class, left
+// if the shares add up to less than 1, can push and pull.
+func unreachable_class(classes []nodeClass, should_push bool, should_pull bool) string {
+	has_nodes := func(c nodeClass) bool {
+		return c.share > 0 || c.nodes != ""
+	}
+
+	total := 0.0
+	pushed := false
+	for _, c := range classes {
+		total += c.share
+		if has_nodes(c) && c.online > 0 && c.push {
+			pushed = true
+		}
+	}
+	pushed = should_push && (pushed || total < 1)
+
+	for _, c := range classes {
+		if !has_nodes(c) {
+			continue
+		}
+		if c.online == 0 || !(pushed || (should_pull && c.pull)) {
+			return c.name
+		}
+	}
+
+	return ""
+}
+
+// assign_classes returns the index in classes of the class of each of
+// node_num nodes, or -1 for nodes without a class. Listed nodes get their
+// class, and the others are shuffled and split by share. If the shares add up
+// to less than 1, the rest of the nodes get no class; otherwise, the shares
+// are relative. The nodes are shuffled with rng. The classes must be valid.
+func assign_classes(classes []nodeClass, node_num int, rng *rand.Rand) []int {
+	assignment := make([]int, node_num)
+	for i := range assignment {
+		assignment[i] = -1
+	}
+
+	total := 0.0
+	for i, c := range classes {
+		nodes, _ := parse_node_list(c.nodes, node_num)
+		for pos := range nodes {
+			assignment[pos] = i
+		}
+		total += c.share
+	}
+
+	rest := []int{}
+	for pos, class := range assignment {
+		if class < 0 {
+			rest = append(rest, pos)
+		}
+	}
+	if total == 0 || len(rest) == 0 {
+		return assignment
+	}
+
+	// Walk the shuffled nodes, giving node k the class whose share covers the
+	// middle of its slot, so each class gets its share rounded to a node.
+	scale := math.Max(total, 1)
+	rng.Shuffle(len(rest), func(i, j int) { rest[i], rest[j] = rest[j], rest[i] })
+	for k, pos := range rest {
+		x := (float64(k) + 0.5) / float64(len(rest)) * scale
+		for i, c := range classes {
+			if x < c.share {
+				assignment[pos] = i
+				break
+			}
+			x -= c.share
+		}
+	}
+
+	return assignment
+}
+
+// nodeStats is what happened to a node during a run of the goroutine engine.
+type nodeStats struct {
+	class   int           // The index of the node's class, or -1.
+	waited  time.Duration // How long the node waited at the barrier, without a leader.
+	offline int           // The number of rounds in which the node was offline.
+	rounds  int           // The number of rounds the node ran.
+}
+
+// classSummary is how the nodes of a class fared during a run.
+type classSummary struct {
+	name     string
+	nodes    int
+	infected int
+	rounds   percentiles   // The rounds in which the class's nodes were infected.
+	offline  float64       // The fraction of the rounds in which the class's nodes were offline.
+	wait     time.Duration // The mean time a node of the class waited at the barrier per round.
+}
+
+// summarize_classes returns a summary per class of result, followed by one
+// for the nodes without a class, if any.
+func summarize_classes(classes []nodeClass, result GossipResult) []classSummary {
+	summaries := make([]classSummary, len(classes)+1)
+	infection_rounds := make([][]float64, len(classes)+1)
+	rounds := make([]int, len(classes)+1)
+	waited := make([]time.Duration, len(classes)+1)
+	offline := make([]int, len(classes)+1)
+
+	for i, c := range classes {
+		summaries[i].name = c.name
+	}
+	summaries[len(classes)].name = "default"
+
+	for pos, stats := range result.node_stats {
+		i := stats.class
+		if i < 0 {
+			i = len(classes)
+		}
+
+		summaries[i].nodes += 1
+		rounds[i] += stats.rounds
+		waited[i] += stats.waited
+		offline[i] += stats.offline
+		if r := result.infections[pos]; r.infected {
+			summaries[i].infected += 1
+			infection_rounds[i] = append(infection_rounds[i], float64(r.round))
+		}
+	}
+
+	kept := []classSummary{}
+	for i, s := range summaries {
+		if s.nodes == 0 && i == len(classes) {
+			continue
+		}
+		if rounds[i] > 0 {
+			s.offline = float64(offline[i]) / float64(rounds[i])
+			s.wait = waited[i] / time.Duration(rounds[i])
+		}
+		sort.Float64s(infection_rounds[i])
+		s.rounds = percentiles_of(infection_rounds[i])
+		kept = append(kept, s)
+	}
+
+	return kept
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseClasses(t *testing.T) {
+	classes, err := parse_classes("server=0.8,fanout=2; edge=0.2,delay=5ms,online=0.7,push=false")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := new_class("server")
+	server.share, server.fanout = 0.8, 2
+	edge := new_class("edge")
+	edge.share, edge.delay, edge.online, edge.push = 0.2, 5*time.Millisecond, 0.7, false
+	if len(classes) != 2 || classes[0] != server || classes[1] != edge {
+		t.Errorf("got %+v, want %+v and %+v", classes, server, edge)
+	}
+
+	for _, spec := range []string{"", "server", "server=x", "server=1,fanout", "server=1,color=red", "server=1,online=high"} {
+		if _, err := parse_classes(spec); err == nil {
+			t.Errorf("%q: parsed", spec)
+		}
+	}
+}
+
+func TestReadClasses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "classes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "classes.json")
+	data := `{"classes": [{"name": "edge", "nodes": "0-9", "delay": "5ms", "online": 0}]}`
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	classes, err := read_classes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edge := new_class("edge")
+	edge.nodes, edge.delay, edge.online = "0-9", 5*time.Millisecond, 0
+	if len(classes) != 1 || classes[0] != edge {
+		t.Errorf("got %+v, want %+v", classes, edge)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"classes": [{"name": "edge", "speed": 2}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := read_classes(path); err == nil {
+		t.Error("read a class with an unknown field")
+	}
+}
+
+func TestCheckClasses(t *testing.T) {
+	valid := new_class("edge")
+
+	tests := []struct {
+		name   string
+		change func(c *nodeClass)
+		valid  bool
+	}{
+		{"valid", func(c *nodeClass) {}, true},
+		{"no name", func(c *nodeClass) { c.name = "" }, false},
+		{"negative share", func(c *nodeClass) { c.share = -1 }, false},
+		{"negative delay", func(c *nodeClass) { c.delay = -1 }, false},
+		{"no fanout", func(c *nodeClass) { c.fanout = 0 }, false},
+		{"online above 1", func(c *nodeClass) { c.online = 1.5 }, false},
+		{"node out of range", func(c *nodeClass) { c.nodes = "5-10" }, false},
+		{"huge range", func(c *nodeClass) { c.nodes = "0-2000000000" }, false},
+		{"invalid nodes", func(c *nodeClass) { c.nodes = "x" }, false},
+	}
+
+	for _, test := range tests {
+		c := valid
+		test.change(&c)
+
+		err := check_classes([]nodeClass{c}, 10)
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if !test.valid && !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("%s: got %v, want ErrInvalidOption", test.name, err)
+		}
+	}
+
+	a, b := new_class("a"), new_class("b")
+	a.nodes, b.nodes = "0-4", "4"
+	if err := check_classes([]nodeClass{a, b}, 10); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("overlapping nodes: got %v, want ErrInvalidOption", err)
+	}
+	if err := check_classes([]nodeClass{a, a}, 10); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("duplicate names: got %v, want ErrInvalidOption", err)
+	}
+}
+
+func TestUnreachableClass(t *testing.T) {
+	server, edge := new_class("server"), new_class("edge")
+	server.share, edge.share = 0.5, 0.5
+
+	tests := []struct {
+		name        string
+		change      func(server *nodeClass, edge *nodeClass)
+		push, pull  bool
+		unreachable string
+	}{
+		{"valid", func(server *nodeClass, edge *nodeClass) {}, true, true, ""},
+		{"never online", func(server *nodeClass, edge *nodeClass) { edge.online = 0 }, true, true, "edge"},
+		{"never online without nodes", func(server *nodeClass, edge *nodeClass) { edge.online, edge.share = 0, 0 }, true, true, ""},
+		{"pushed to", func(server *nodeClass, edge *nodeClass) { edge.push, edge.pull = false, false }, true, false, ""},
+		{"nobody pushes", func(server *nodeClass, edge *nodeClass) { server.push, edge.push = false, false }, true, false, "server"},
+		{"pulls instead", func(server *nodeClass, edge *nodeClass) { server.push, edge.push = false, false }, true, true, ""},
+		{"pushed by nodes without a class", func(server *nodeClass, edge *nodeClass) {
+			server.push, edge.push, edge.share = false, false, 0.2
+		}, true, false, ""},
+	}
+
+	for _, test := range tests {
+		s, e := server, edge
+		test.change(&s, &e)
+
+		if name := unreachable_class([]nodeClass{s, e}, test.push, test.pull); name != test.unreachable {
+			t.Errorf("%s: got %q, want %q", test.name, name, test.unreachable)
+		}
+	}
+}
+
+func TestAssignClasses(t *testing.T) {
+	listed, server, edge := new_class("listed"), new_class("server"), new_class("edge")
+	listed.nodes = "0-9"
+	server.share, edge.share = 0.3, 0.5
+
+	assignment := assign_classes([]nodeClass{listed, server, edge}, 110, rand.New(rand.NewSource(1)))
+	counts := map[int]int{}
+	for pos, class := range assignment {
+		if pos < 10 && class != 0 {
+			t.Errorf("listed node %d got class %d", pos, class)
+		}
+		counts[class] += 1
+	}
+
+	// The 100 nodes that are not listed are split by share, and the rest get
+	// no class.
+	want := map[int]int{0: 10, 1: 30, 2: 50, -1: 20}
+	for class, count := range want {
+		if counts[class] != count {
+			t.Errorf("class %d: got %d nodes, want %d", class, counts[class], count)
+		}
+	}
+}
+
+// TestClassBehaviour checks that nodes follow their class in every network
+// mode of the goroutine engine: nodes that are never online are never
+// infected, nodes that cannot push never infect by push, and every node that
+// can be infected is.
+func TestClassBehaviour(t *testing.T) {
+	offline, pull_only := new_class("offline"), new_class("pull only")
+	offline.nodes, offline.online = "200-209", 0
+	pull_only.nodes, pull_only.push = "100-149", false
+
+	for _, mode := range testModes[:3] {
+		config := mode.config(true, true)
+		config.classes = []nodeClass{offline, pull_only}
+		config.max_rounds = 30
+		if mode.async {
+			config.max_rounds = 200
+		}
+
+		result := run_config(t, mode.name, config, ErrMaxRounds)
+		if result.infected != testNodes-10 {
+			t.Errorf("%s: %d nodes infected, want %d", mode.name, result.infected, testNodes-10)
+		}
+
+		for pos, r := range result.infections {
+			if pos >= 200 && pos < 210 && r.infected {
+				t.Errorf("%s: offline node %d is infected", mode.name, pos)
+			}
+			if r.infected && !r.pull && r.from >= 100 && r.from < 150 {
+				t.Errorf("%s: node %d was pushed by pull-only node %d", mode.name, pos, r.from)
+			}
+		}
+
+		summaries := summarize_classes(config.classes, result)
+		if len(summaries) != 3 || summaries[0].offline != 1 || summaries[1].infected != 50 {
+			t.Errorf("%s: got summaries %+v", mode.name, summaries)
+		}
+	}
+}
+
+// TestClassFanout checks that with a leader, each infected node pushes to
+// fanout peers in each round.
+func TestClassFanout(t *testing.T) {
+	wide := new_class("wide")
+	wide.share, wide.fanout = 1, 3
+
+	config := testModes[0].config(true, false)
+	config.infected_num = 4
+	config.classes = []nodeClass{wide}
+	config.max_rounds = 1
+
+	result := run_config(t, "leader", config, ErrMaxRounds)
+	if len(result.messages) != 1 || result.messages[0] != 12 {
+		t.Errorf("got messages %v, want 12 in the first round", result.messages)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// exitRegression is the exit code of compare when a configuration got
+// significantly worse.
+const exitRegression = 3
+
+// benchKey is a configuration of the benchmark.
+type benchKey struct {
+	algorithm string
+	network   string
+	nodes     int
+	infected  int
+}
+
+// benchRuns holds the repetitions of a configuration of the benchmark.
+type benchRuns struct {
+	duration []float64 // Milliseconds.
+	rounds   []float64 // Average rounds.
+	messages []float64 // Messages sent, missing in older outputs.
+}
+
+// read_bench reads the output of the bench command, tab- or comma-separated,
+// and returns the runs of each configuration in the order they first appear.
+// Lines that are not runs, such as the comparisons with the median-counter
+// algorithm, headers and log lines, are skipped.
+func read_bench(r io.Reader) (map[benchKey]*benchRuns, []benchKey, error) {
+	runs := map[benchKey]*benchRuns{}
+	var keys []benchKey
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		sep := "\t"
+		if !strings.Contains(line, sep) {
+			sep = ","
+		}
+		fields := strings.Split(line, sep)
+		if len(fields) < 6 || fields[0] == "compare" {
+			continue
+		}
+
+		nodes, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+		infected, err := strconv.Atoi(fields[3])
+		if err != nil {
+			continue
+		}
+		duration, err := strconv.ParseFloat(fields[4], 64)
+		if err != nil {
+			continue
+		}
+		rounds, err := strconv.ParseFloat(fields[5], 64)
+		if err != nil {
+			continue
+		}
+
+		key := benchKey{fields[0], fields[1], nodes, infected}
+		r := runs[key]
+		if r == nil {
+			r = &benchRuns{}
+			runs[key] = r
+			keys = append(keys, key)
+		}
+		r.duration = append(r.duration, duration)
+		r.rounds = append(r.rounds, rounds)
+		if len(fields) > 15 {
+			if messages, err := strconv.ParseFloat(fields[15], 64); err == nil {
+				r.messages = append(r.messages, messages)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(keys) == 0 {
+		return nil, nil, fmt.Errorf("no bench results")
+	}
+
+	return runs, keys, nil
+}
+
+// read_bench_file reads the output of the bench command from a file.
+func read_bench_file(path string) (map[benchKey]*benchRuns, []benchKey, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	runs, keys, err := read_bench(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return runs, keys, nil
+}
+
+// benchDelta compares a metric of a configuration between two outputs.
+type benchDelta struct {
+	key        benchKey
+	metric     string
+	old, new   float64 // The means of the repetitions.
+	change     float64 // The relative change of the mean.
+	p          float64 // The two-sided p-value of Welch's t-test.
+	regression bool    // Whether the metric got significantly worse.
+	improved   bool    // Whether the metric got significantly better.
+}
+
+// compare_bench compares the configurations in both outputs, metric by
+// metric. All metrics are better when lower, so a metric regressed when its
+// mean grew by at least min_change, relative to the old mean, with a p-value
+// below alpha. It also returns the configurations in only one of them.
+func compare_bench(old_runs map[benchKey]*benchRuns, new_runs map[benchKey]*benchRuns, keys []benchKey, alpha float64, min_change float64) ([]benchDelta, int) {
+	var deltas []benchDelta
+	unmatched := len(new_runs)
+
+	for _, key := range keys {
+		o, n := old_runs[key], new_runs[key]
+		if n == nil {
+			unmatched += 1
+			continue
+		}
+		unmatched -= 1
+
+		metrics := []struct {
+			name     string
+			old, new []float64
+		}{
+			{"rounds", o.rounds, n.rounds},
+			{"ms", o.duration, n.duration},
+			{"messages", o.messages, n.messages},
+		}
+		for _, m := range metrics {
+			if len(m.old) == 0 || len(m.new) == 0 {
+				continue
+			}
+
+			d := benchDelta{key: key, metric: m.name, old: mean(m.old), new: mean(m.new), p: welch_t_test(m.old, m.new)}
+			if d.old != 0 {
+				d.change = (d.new - d.old) / d.old
+			} else if d.new != 0 {
+				d.change = math.Inf(1)
+			}
+			significant := d.p < alpha && math.Abs(d.change) >= min_change
+			d.regression = significant && d.new > d.old
+			d.improved = significant && d.new < d.old
+			deltas = append(deltas, d)
+		}
+	}
+
+	return deltas, unmatched
+}
+
+// mean returns the arithmetic mean of values.
+func mean(values []float64) float64 {
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+
+	return sum / float64(len(values))
+}
+
+// variance returns the unbiased sample variance of values.
+func variance(values []float64) float64 {
+	m := mean(values)
+	sum := 0.0
+	for _, v := range values {
+		sum += (v - m) * (v - m)
+	}
+
+	return sum / float64(len(values)-1)
+}
+
+// welch_t_test returns the two-sided p-value of Welch's t-test that a and b
+// have the same mean. Without at least two values in each it returns 1, and
+// without any variance 0 if the means differ.
+func welch_t_test(a []float64, b []float64) float64 {
+	if len(a) < 2 || len(b) < 2 {
+		return 1
+	}
+
+	na, nb := float64(len(a)), float64(len(b))
+	va, vb := variance(a)/na, variance(b)/nb
+	diff := mean(b) - mean(a)
+	if va+vb == 0 {
+		if diff == 0 {
+			return 1
+		}
+		return 0
+	}
+
+	t := diff / math.Sqrt(va+vb)
+	df := (va + vb) * (va + vb) / (va*va/(na-1) + vb*vb/(nb-1))
+
+	return incomplete_beta(df/2, 0.5, df/(df+t*t))
+}
+
+// incomplete_beta returns the regularized incomplete beta function I_x(a, b),
+// from its continued fraction.
+func incomplete_beta(a float64, b float64, x float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	if x >= 1 {
+		return 1
+	}
+
+	lga, _ := math.Lgamma(a)
+	lgb, _ := math.Lgamma(b)
+	lgab, _ := math.Lgamma(a + b)
+	front := math.Exp(lgab - lga - lgb + a*math.Log(x) + b*math.Log(1-x))
+
+	// The continued fraction converges quickly only below this point, so
+	// above it use the symmetry I_x(a, b) = 1 - I_{1-x}(b, a).
+	if x > (a+1)/(a+b+2) {
+		return 1 - front*beta_fraction(b, a, 1-x)/b
+	}
+
+	return front * beta_fraction(a, b, x) / a
+}
+
+// beta_fraction evaluates the continued fraction of the incomplete beta
+// function with the modified Lentz method.
+func beta_fraction(a float64, b float64, x float64) float64 {
+	const tiny = 1e-300
+
+	c, d := 1.0, 1-(a+b)*x/(a+1)
+	if math.Abs(d) < tiny {
+		d = tiny
+	}
+	d = 1 / d
+	f := d
+
+	for m := 1.0; m <= 300; m++ {
+		// The even step.
+		num := m * (b - m) * x / ((a + 2*m - 1) * (a + 2*m))
+		d = 1 + num*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = 1 + num/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		f *= d * c
+
+		// The odd step.
+		num = -(a + m) * (a + b + m) * x / ((a + 2*m) * (a + 2*m + 1))
+		d = 1 + num*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = 1 + num/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		delta := d * c
+		f *= delta
+
+		if math.Abs(delta-1) < 1e-14 {
+			break
+		}
+	}
+
+	return f
+}
+
+// runCompare compares the bench outputs in old_path and new_path, prints a
+// tab-separated line per configuration and metric, and returns the number of
+// regressions.
+func runCompare(old_path string, new_path string, alpha float64, min_change float64, out io.Writer) (int, error) {
+	if alpha <= 0 || alpha >= 1 {
+		return 0, &ConfigError{"--alpha", fmt.Sprint(alpha), "must be between 0 and 1", ErrInvalidOption}
+	}
+	if min_change < 0 {
+		return 0, &ConfigError{"--min-change", fmt.Sprint(min_change), "must not be negative", ErrInvalidOption}
+	}
+
+	old_runs, keys, err := read_bench_file(old_path)
+	if err != nil {
+		return 0, err
+	}
+	new_runs, _, err := read_bench_file(new_path)
+	if err != nil {
+		return 0, err
+	}
+
+	deltas, unmatched := compare_bench(old_runs, new_runs, keys, alpha, min_change)
+	sort.SliceStable(deltas, func(i, j int) bool {
+		return deltas[i].regression && !deltas[j].regression
+	})
+
+	regressions, improvements := 0, 0
+	fmt.Fprintln(out, "algorithm\tnetwork\tnodes\tinfected\tmetric\told\tnew\tchange\tp\tverdict")
+	for _, d := range deltas {
+		verdict := "-"
+		switch {
+		case d.regression:
+			verdict = "regression"
+			regressions += 1
+		case d.improved:
+			verdict = "improvement"
+			improvements += 1
+		}
+		fmt.Fprintf(out, "%s\t%s\t%d\t%d\t%s\t%.6g\t%.6g\t%+.1f%%\t%.4f\t%s\n", d.key.algorithm, d.key.network, d.key.nodes, d.key.infected,
+			d.metric, d.old, d.new, 100*d.change, d.p, verdict)
+	}
+
+	fmt.Fprintf(out, "Compared %d metrics: %d regressions, %d improvements, %d configurations in only one file\n",
+		len(deltas), regressions, improvements, unmatched)
+
+	return regressions, nil
+}
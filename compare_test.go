@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWelchTTest(t *testing.T) {
+	tests := []struct {
+		a, b []float64
+		p    float64
+	}{
+		{[]float64{1, 2, 3}, []float64{4, 5, 6}, 0.0213},
+		{[]float64{1, 2, 3}, []float64{1, 2, 3}, 1},
+		{[]float64{10, 12, 11, 13}, []float64{11, 15, 9, 20, 14}, 0.3007},
+		{[]float64{5, 5, 5}, []float64{6, 6, 6}, 0},
+		{[]float64{5}, []float64{6, 6, 6}, 1},
+	}
+	for _, test := range tests {
+		if p := welch_t_test(test.a, test.b); math.Abs(p-test.p) > 1e-4 {
+			t.Errorf("%v, %v: got %f, want %f", test.a, test.b, p, test.p)
+		}
+	}
+}
+
+// TestCompare compares two bench outputs, one of them without the messages,
+// and checks that only the regression is flagged.
+func TestCompare(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compare")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := strings.Join([]string{
+		"push\tleader\t512\t1\t10.0\t12.0",
+		"push\tleader\t512\t1\t11.0\t13.0",
+		"push\tleader\t512\t1\t12.0\t12.0",
+		"pull\tasync\t512\t1\t5.0\t9.0",
+		"pull\tasync\t512\t1\t5.0\t9.0",
+		"pull\tasync\t16\t1\t1.0\t4.0",
+		"compare\t16\t100\t80\t0.8\t4\t5\ttrue",
+	}, "\n")
+	new := strings.Join([]string{
+		"algorithm,network,nodes,infected,ms,rounds",
+		"push,leader,512,1,20.0,12.0,0,0,0,0,0,0,0,0,0,6000",
+		"push,leader,512,1,21.0,13.0,0,0,0,0,0,0,0,0,0,6100",
+		"push,leader,512,1,22.0,12.0,0,0,0,0,0,0,0,0,0,6200",
+		"pull,async,512,1,5.0,9.0",
+		"pull,async,512,1,5.0,9.0",
+		"pushpull,sync,16,1,1.0,4.0",
+	}, "\n")
+	old_path, new_path := filepath.Join(dir, "old.tsv"), filepath.Join(dir, "new.csv")
+	if err := ioutil.WriteFile(old_path, []byte(old), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(new_path, []byte(new), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	regressions, err := runCompare(old_path, new_path, 0.05, 0.05, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if regressions != 1 || len(lines) != 6 || !strings.HasPrefix(lines[1], "push\tleader\t512\t1\tms\t11\t21\t+90.9%") || !strings.HasSuffix(lines[1], "regression") {
+		t.Fatalf("got %d regressions:\n%s", regressions, out.String())
+	}
+	if !strings.Contains(out.String(), "Compared 4 metrics: 1 regressions, 0 improvements, 2 configurations in only one file") {
+		t.Errorf("got summary:\n%s", out.String())
+	}
+
+	if _, err := runCompare(old_path, new_path, 0, 0.05, &out); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("got %v, want ErrInvalidOption", err)
+	}
+	if _, err := runCompare(old_path, filepath.Join(dir, "missing.csv"), 0.05, 0.05, &out); err == nil {
+		t.Error("comparing with a missing file succeeded")
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// The reasons a configuration can be invalid. Validation returns a
+// *ConfigError wrapping one of these, so callers can use errors.Is.
+var (
+	ErrTooFewNodes        = errors.New("too few nodes")
+	ErrNoInitialInfection = errors.New("no initially infected node")
+	ErrTooManyInfected    = errors.New("more infected nodes than nodes")
+	ErrNoAlgorithm        = errors.New("neither push nor pull is enabled")
+	ErrConflictingNetwork = errors.New("conflicting network modes")
+	ErrInvalidOption      = errors.New("invalid option")
+)
+
+// ConfigError describes an invalid option of a configuration.
+type ConfigError struct {
+	Option string      // The commandline name of the option.
+	Value  interface{} // The invalid value.
+	Reason string      // What a valid value would be.
+	Err    error       // One of the Err* values above.
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid %s %v: %v (%s)", e.Option, e.Value, e.Err, e.Reason)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+type gossipConfig struct {
+	node_num     int
+	infected_num int
+	should_push  bool
+	should_pull  bool
+	median       bool // Whether to run the median-counter push-pull of Karp et al. instead of plain push-pull.
+	async        bool
+	leader       bool
+	engine       string  // How a synchronous network is run: engineGoroutine, enginePool or engineBitset, or "" for goroutines.
+	poisson_rate float64 // The rate of each node's clock in the Poisson model, or 0 for another network mode.
+	ttl          int     // The most hops the rumor is forwarded, or 0 for no limit.
+	max_age      int     // The most rounds a node forwards the rumor after getting it, or 0 for no limit.
+	view_size    int     // The size of each node's partial view, or 0 for global membership.
+	shuffle_len  int     // The number of entries exchanged per shuffle, or 0 for half the view.
+
+	classes []nodeClass // The classes of heterogeneous nodes, or nil if all nodes are alike.
+
+	until_stopped bool // Whether to run until no node forwards the rumor, even once every node is infected. Only with the pool engine and a maximum age.
+
+	partition  []int // The group of each node while the network is partitioned, or nil.
+	heal_round int   // The round after which the partition heals, or 0 to never heal.
+
+	events []scenarioEvent // The events of a scenario, applied by the leader between rounds, or nil.
+
+	observer RoundObserver // Called at the end of each round, or nil.
+	stepper  PhaseObserver // Called by the leader between phases, or nil.
+	tracer   *tracer       // Records the events of the run, or nil.
+
+	barrier_timeout time.Duration // How long a barrier generation may take without a leader, or 0.
+	max_rounds      int           // The number of rounds after which to give up, or 0.
+	timeout         time.Duration // How long to run before giving up, or 0.
+	seed            int64         // The seed for random peer selection, or 0 to seed from the clock.
+}
+
+// algorithm returns the name of the gossip algorithm: push, pull, pushpull or
+// median.
+func (c gossipConfig) algorithm() string {
+	if c.median {
+		return "median"
+	}
+
+	alg := ""
+	if c.should_push {
+		alg = "push"
+	}
+	if c.should_pull {
+		alg += "pull"
+	}
+
+	return alg
+}
+
+// network_mode returns the name of the network mode: async, sync, leader,
+// poisson, or pool or bitset for a synchronous network run by those engines.
+func (c gossipConfig) network_mode() string {
+	if c.poisson_rate > 0 {
+		return "poisson"
+	} else if c.engine == enginePool || c.engine == engineBitset {
+		return c.engine
+	} else if c.async && !c.leader {
+		return "async"
+	} else if !c.leader {
+		return "sync"
+	}
+
+	return "leader"
+}
+
+// rumor_max_age returns the most rounds a node forwards the rumor after getting
+// it, or 0 for no limit. A TTL alone bounds the flood too: each node forwards
+// the rumor for default_max_age rounds, so the run ends once no node below the
+// TTL forwards it.
+func (c gossipConfig) rumor_max_age() int {
+	if c.max_age == 0 && c.ttl > 0 {
+		return default_max_age(c.node_num)
+	}
+
+	return c.max_age
+}
+
+// uniform returns the configuration with uniform peer selection over global
+// membership instead of peer sampling.
+func (c gossipConfig) uniform() gossipConfig {
+	c.view_size = 0
+	c.shuffle_len = 0
+
+	return c
+}
+
+// validate returns a *ConfigError for the first invalid option, or nil. Without
+// validation, some configurations never finish: nobody gets infected without
+// an initially infected node, and a single node has no peer to pick.
+func (c gossipConfig) validate() error {
+	switch {
+	case c.node_num < 2:
+		return &ConfigError{"-n", c.node_num, "need at least 2 nodes", ErrTooFewNodes}
+	case c.infected_num < 1:
+		return &ConfigError{"-i", c.infected_num, "need at least 1 infected node", ErrNoInitialInfection}
+	case c.infected_num > c.node_num:
+		return &ConfigError{"-i", c.infected_num, fmt.Sprintf("need at most %d, the number of nodes", c.node_num), ErrTooManyInfected}
+	case !c.should_push && !c.should_pull:
+		return &ConfigError{"algorithm", c.algorithm(), "use push, pull or pushpull", ErrNoAlgorithm}
+	case c.async && c.leader:
+		return &ConfigError{"-a", c.async, "-a and -l cannot be used together", ErrConflictingNetwork}
+	case c.engine != "" && c.engine != engineGoroutine && c.engine != enginePool && c.engine != engineBitset:
+		return &ConfigError{"--engine", c.engine, "use goroutine, pool or bitset", ErrInvalidOption}
+	case (c.engine == enginePool || c.engine == engineBitset) && c.async:
+		return &ConfigError{"--engine", c.engine, "the engine only runs synchronous networks", ErrConflictingNetwork}
+	case c.poisson_rate < 0 || math.IsNaN(c.poisson_rate) || math.IsInf(c.poisson_rate, 0):
+		return &ConfigError{"--poisson", c.poisson_rate, "need a positive rate, or 0 for another network mode", ErrInvalidOption}
+	case c.poisson_rate > 0 && c.leader:
+		return &ConfigError{"--poisson", c.poisson_rate, "the Poisson model is asynchronous, and cannot be used with -l", ErrConflictingNetwork}
+	case c.poisson_rate > 0 && c.engine != "" && c.engine != engineGoroutine:
+		return &ConfigError{"--poisson", c.poisson_rate, "the Poisson model cannot be used with --engine", ErrConflictingNetwork}
+	case c.poisson_rate > 0 && c.view_size > 0:
+		return &ConfigError{"-k", c.view_size, "the Poisson model only uses global membership", ErrInvalidOption}
+	case c.view_size < 0 || c.view_size >= c.node_num:
+		return &ConfigError{"-k", c.view_size, fmt.Sprintf("need between 0 and %d, one less than the number of nodes", c.node_num-1), ErrInvalidOption}
+	case (c.engine == enginePool || c.engine == engineBitset) && c.view_size > 0:
+		return &ConfigError{"-k", c.view_size, "the engine only uses global membership", ErrInvalidOption}
+	case c.engine == engineBitset && c.tracer != nil:
+		return &ConfigError{"--trace", true, "the bitset engine has no per-node events to trace", ErrInvalidOption}
+	case c.shuffle_len < 0 || c.shuffle_len > c.view_size:
+		return &ConfigError{"-s", c.shuffle_len, "need between 0 and the view size", ErrInvalidOption}
+	case c.median && !(c.should_push && c.should_pull):
+		return &ConfigError{"algorithm", c.algorithm(), "the median-counter algorithm needs both push and pull", ErrInvalidOption}
+	case c.median && (c.async || c.poisson_rate > 0 || c.engine == enginePool || c.engine == engineBitset):
+		return &ConfigError{"algorithm", c.algorithm(), "the median-counter algorithm runs in its own synchronous rounds, and cannot be used with -a, --poisson or --engine", ErrConflictingNetwork}
+	case c.median && c.view_size > 0:
+		return &ConfigError{"-k", c.view_size, "the median-counter algorithm only uses global membership", ErrInvalidOption}
+	case c.ttl < 0:
+		return &ConfigError{"--ttl", c.ttl, "need 0 for no limit, or more", ErrInvalidOption}
+	case c.max_age < 0:
+		return &ConfigError{"--max-age", c.max_age, "need 0 for no limit, or more", ErrInvalidOption}
+	case (c.ttl > 0 || c.max_age > 0) && c.median:
+		return &ConfigError{"--ttl", c.ttl, "the median-counter algorithm decides itself when nodes stop forwarding", ErrInvalidOption}
+	case (c.ttl > 0 || c.max_age > 0) && c.engine == engineBitset:
+		return &ConfigError{"--ttl", c.ttl, "the bitset engine does not record the hops of each node", ErrInvalidOption}
+	case c.until_stopped && (c.engine != enginePool || c.rumor_max_age() == 0):
+		return &ConfigError{"--max-age", c.max_age, "running until no node forwards the rumor needs a maximum age and the pool engine", ErrInvalidOption}
+	case c.median && c.classes != nil:
+		return &ConfigError{"--classes", "with median", "node classes need the goroutine engine", ErrConflictingNetwork}
+	case c.classes != nil && (c.poisson_rate > 0 || c.engine == enginePool || c.engine == engineBitset):
+		return &ConfigError{"--classes", "with " + c.network_mode(), "node classes need the goroutine engine", ErrConflictingNetwork}
+	case c.partition != nil && len(c.partition) != c.node_num:
+		return &ConfigError{"--partition", len(c.partition), fmt.Sprintf("need a group for each of the %d nodes", c.node_num), ErrInvalidOption}
+	case c.partition != nil && c.engine == engineBitset:
+		return &ConfigError{"--partition", "with bitset", "the bitset engine does not send messages between nodes", ErrConflictingNetwork}
+	case c.heal_round < 0:
+		return &ConfigError{"--heal", c.heal_round, "need 0 to never heal, or more", ErrInvalidOption}
+	case c.heal_round > 0 && c.partition == nil:
+		return &ConfigError{"--heal", c.heal_round, "there is no --partition to heal", ErrInvalidOption}
+	case c.partition != nil && c.heal_round == 0 && c.max_rounds == 0 && c.timeout == 0:
+		return &ConfigError{"--partition", "without --heal", "a partition that never heals needs --max-rounds or --timeout", ErrInvalidOption}
+	case c.events != nil && (!c.leader || c.median || c.poisson_rate > 0 || (c.engine != "" && c.engine != engineGoroutine)):
+		return &ConfigError{"run", "with " + c.network_mode(), "the leader of the goroutine engine applies the events between rounds", ErrConflictingNetwork}
+	case c.stepper != nil && (!c.leader || c.median || c.poisson_rate > 0 || (c.engine != "" && c.engine != engineGoroutine)):
+		return &ConfigError{"repl", "with " + c.network_mode(), "only the leader of the goroutine engine can be stepped through", ErrConflictingNetwork}
+	case c.max_rounds < 0:
+		return &ConfigError{"--max-rounds", c.max_rounds, "need 0 for no limit, or more", ErrInvalidOption}
+	case c.timeout < 0:
+		return &ConfigError{"--timeout", c.timeout, "need 0 for no limit, or more", ErrInvalidOption}
+	case c.barrier_timeout < 0:
+		return &ConfigError{"--barrier-timeout", c.barrier_timeout, "need 0 for no timeout, or more", ErrInvalidOption}
+	}
+
+	if c.classes != nil {
+		if err := check_classes(c.classes, c.node_num); err != nil {
+			return err
+		}
+		name := unreachable_class(c.classes, c.should_push, c.should_pull)
+		if name != "" && c.max_rounds == 0 && c.timeout == 0 {
+			return &ConfigError{"--classes", name, "a class whose nodes can never be infected needs --max-rounds or --timeout", ErrInvalidOption}
+		}
+	}
+	if c.events != nil {
+		return check_events(c.events, c.node_num)
+	}
+
+	return nil
+}
+
+// validate_aggregate returns a *ConfigError for the first invalid option of an
+// aggregation run, or nil.
+func validate_aggregate(c gossipConfig, function string, tolerance float64, max_rounds int) error {
+	switch function {
+	case aggAverage, aggSum, aggCount, aggMin, aggMax:
+	default:
+		return &ConfigError{"-f", function, "use avg, sum, count, min or max", ErrInvalidOption}
+	}
+
+	switch {
+	case c.node_num < 2:
+		return &ConfigError{"-n", c.node_num, "need at least 2 nodes", ErrTooFewNodes}
+	case c.view_size < 0 || c.view_size >= c.node_num:
+		return &ConfigError{"-k", c.view_size, fmt.Sprintf("need between 0 and %d, one less than the number of nodes", c.node_num-1), ErrInvalidOption}
+	case c.shuffle_len < 0 || c.shuffle_len > c.view_size:
+		return &ConfigError{"-s", c.shuffle_len, "need between 0 and the view size", ErrInvalidOption}
+	case tolerance < 0:
+		return &ConfigError{"-t", tolerance, "need 0 or more", ErrInvalidOption}
+	case max_rounds < 1:
+		return &ConfigError{"-r", max_rounds, "need at least 1 round", ErrInvalidOption}
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	valid := gossipConfig{node_num: 10, infected_num: 1, should_push: true}
+
+	tests := []struct {
+		name   string
+		change func(c *gossipConfig)
+		err    error
+	}{
+		{"valid", func(c *gossipConfig) {}, nil},
+		{"one node", func(c *gossipConfig) { c.node_num = 1 }, ErrTooFewNodes},
+		{"negative nodes", func(c *gossipConfig) { c.node_num = -5 }, ErrTooFewNodes},
+		{"no infected", func(c *gossipConfig) { c.infected_num = 0 }, ErrNoInitialInfection},
+		{"too many infected", func(c *gossipConfig) { c.infected_num = 11 }, ErrTooManyInfected},
+		{"all infected", func(c *gossipConfig) { c.infected_num = 10 }, nil},
+		{"no algorithm", func(c *gossipConfig) { c.should_push = false }, ErrNoAlgorithm},
+		{"async and leader", func(c *gossipConfig) { c.async, c.leader = true, true }, ErrConflictingNetwork},
+		{"view too large", func(c *gossipConfig) { c.view_size = 10 }, ErrInvalidOption},
+		{"shuffle without view", func(c *gossipConfig) { c.shuffle_len = 1 }, ErrInvalidOption},
+		{"shuffle larger than view", func(c *gossipConfig) { c.view_size, c.shuffle_len = 4, 5 }, ErrInvalidOption},
+		{"classes with pool", func(c *gossipConfig) { c.classes, c.engine = []nodeClass{new_class("a")}, enginePool }, ErrConflictingNetwork},
+		{"invalid class", func(c *gossipConfig) { c.classes = []nodeClass{{name: "a"}} }, ErrInvalidOption},
+		{"class never online", func(c *gossipConfig) { c.classes = []nodeClass{{name: "a", share: 1, fanout: 1, push: true}} }, ErrInvalidOption},
+		{"class never online with max rounds", func(c *gossipConfig) {
+			c.classes, c.max_rounds = []nodeClass{{name: "a", share: 1, fanout: 1, push: true}}, 20
+		}, nil},
+		{"median without pull", func(c *gossipConfig) { c.median = true }, ErrInvalidOption},
+		{"median in async", func(c *gossipConfig) { c.median, c.should_pull, c.async = true, true, true }, ErrConflictingNetwork},
+		{"negative ttl", func(c *gossipConfig) { c.ttl = -1 }, ErrInvalidOption},
+		{"negative max age", func(c *gossipConfig) { c.max_age = -1 }, ErrInvalidOption},
+		{"ttl with bitset", func(c *gossipConfig) { c.ttl, c.engine = 3, engineBitset }, ErrInvalidOption},
+		{"until stopped without max age", func(c *gossipConfig) { c.until_stopped, c.engine = true, enginePool }, ErrInvalidOption},
+		{"until stopped", func(c *gossipConfig) { c.until_stopped, c.engine, c.max_age = true, enginePool, 4 }, nil},
+		{"partition of other nodes", func(c *gossipConfig) { c.partition, c.heal_round = make([]int, 5), 3 }, ErrInvalidOption},
+		{"partition with bitset", func(c *gossipConfig) { c.partition, c.heal_round, c.engine = make([]int, 10), 3, engineBitset }, ErrConflictingNetwork},
+		{"heal without partition", func(c *gossipConfig) { c.heal_round = 3 }, ErrInvalidOption},
+		{"partition that never heals", func(c *gossipConfig) { c.partition = make([]int, 10) }, ErrInvalidOption},
+		{"partition with max rounds", func(c *gossipConfig) { c.partition, c.max_rounds = make([]int, 10), 20 }, nil},
+		{"negative max rounds", func(c *gossipConfig) { c.max_rounds = -1 }, ErrInvalidOption},
+		{"negative timeout", func(c *gossipConfig) { c.timeout = -1 }, ErrInvalidOption},
+		{"negative barrier timeout", func(c *gossipConfig) { c.barrier_timeout = -1 }, ErrInvalidOption},
+	}
+
+	for _, test := range tests {
+		c := valid
+		test.change(&c)
+
+		err := c.validate()
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+
+		var config_err *ConfigError
+		if test.err != nil && !errors.As(err, &config_err) {
+			t.Errorf("%s: got %T, want *ConfigError", test.name, err)
+		}
+	}
+}
+
+// TestUniform checks that a configuration with peer sampling and a shuffle
+// length, as with -k 8 -s 4, stays valid without peer sampling.
+func TestUniform(t *testing.T) {
+	config := gossipConfig{node_num: 200, infected_num: 1, should_push: true, should_pull: true, view_size: 8, shuffle_len: 4}
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	uniform := config.uniform()
+	if uniform.view_size != 0 || uniform.shuffle_len != 0 {
+		t.Errorf("got view %d and shuffle %d", uniform.view_size, uniform.shuffle_len)
+	}
+	if _, err := StartGossip(context.Background(), uniform); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStartGossipInvalid(t *testing.T) {
+	_, err := StartGossip(context.Background(), gossipConfig{node_num: 1, infected_num: 1, should_push: true})
+	if !errors.Is(err, ErrTooFewNodes) {
+		t.Errorf("got %v, want ErrTooFewNodes", err)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// percentiles summarizes a distribution of values.
+type percentiles struct {
+	p50, p90, p99, max float64
+}
+
+// rank returns the nearest rank, from 1, of the pth quantile of total values.
+func rank(p float64, total int) int {
+	r := int(math.Ceil(p * float64(total)))
+	if r < 1 {
+		r = 1
+	}
+
+	return r
+}
+
+// percentiles_of returns the nearest-rank percentiles of values, which must
+// be sorted.
+func percentiles_of(values []float64) percentiles {
+	if len(values) == 0 {
+		return percentiles{}
+	}
+
+	at := func(p float64) float64 {
+		return values[rank(p, len(values))-1]
+	}
+
+	return percentiles{at(0.5), at(0.9), at(0.99), values[len(values)-1]}
+}
+
+// histogram_percentiles returns the nearest-rank percentiles of the values
+// counted in histogram, where histogram[v] is the number of times v occurs.
+// Unlike percentiles_of, it does not need a value per node.
+func histogram_percentiles(histogram []int) percentiles {
+	total := 0
+	for _, count := range histogram {
+		total += count
+	}
+	if total == 0 {
+		return percentiles{}
+	}
+
+	at := func(p float64) float64 {
+		r := rank(p, total)
+		seen := 0
+		for v, count := range histogram {
+			seen += count
+			if seen >= r {
+				return float64(v)
+			}
+		}
+		return float64(len(histogram) - 1)
+	}
+
+	return percentiles{at(0.5), at(0.9), at(0.99), at(1)}
+}
+
+// infectionDistribution is when the nodes of a run became infected, counting
+// the initially infected nodes as infected in round 0 at time 0.
+type infectionDistribution struct {
+	histogram   []int       // The number of nodes infected in each round, from round 0.
+	rounds      percentiles // The rounds in which nodes were infected. The max is the rounds until the last node.
+	elapsed     percentiles // The wall clock nanoseconds since the start at which nodes were infected.
+	sim_time    percentiles // The simulated time at which nodes were infected, in the Poisson model.
+	hops        percentiles // The hops the rumor took to the infected nodes.
+	has_records bool        // Whether the engine recorded each infection, with its time and the hops the rumor took.
+}
+
+// infection_distribution returns the distribution of the infection rounds and
+// times of result. The rounds are computed from the infection curve, so they
+// are available from every engine. The times and hops need the infection
+// records.
+func infection_distribution(result GossipResult) infectionDistribution {
+	d := infectionDistribution{histogram: make([]int, len(result.curve))}
+
+	for round, total := range result.curve {
+		d.histogram[round] = total
+		if round > 0 {
+			d.histogram[round] -= result.curve[round-1]
+		}
+	}
+	d.rounds = histogram_percentiles(d.histogram)
+
+	if result.infections == nil {
+		return d
+	}
+
+	d.has_records = true
+	elapsed := make([]float64, 0, result.infected)
+	sim_time := make([]float64, 0, result.infected)
+	hops := make([]float64, 0, result.infected)
+	for _, r := range result.infections {
+		if r.infected {
+			elapsed = append(elapsed, float64(r.at))
+			sim_time = append(sim_time, r.time)
+			hops = append(hops, float64(r.hops))
+		}
+	}
+	sort.Float64s(elapsed)
+	sort.Float64s(sim_time)
+	sort.Float64s(hops)
+	d.elapsed = percentiles_of(elapsed)
+	d.sim_time = percentiles_of(sim_time)
+	d.hops = percentiles_of(hops)
+
+	return d
+}
+
+// durations returns the percentiles of nanoseconds as durations, rounded to
+// microseconds.
+func (p percentiles) durations() [4]time.Duration {
+	round := func(ns float64) time.Duration {
+		return time.Duration(ns).Round(time.Microsecond)
+	}
+
+	return [4]time.Duration{round(p.p50), round(p.p90), round(p.p99), round(p.max)}
+}
@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestPercentiles(t *testing.T) {
+	values := make([]float64, 100)
+	histogram := make([]int, 100)
+	for i := range values {
+		values[i] = float64(i)
+		histogram[i] = 1
+	}
+
+	want := percentiles{p50: 49, p90: 89, p99: 98, max: 99}
+	if got := percentiles_of(values); got != want {
+		t.Errorf("percentiles_of: got %+v, want %+v", got, want)
+	}
+	if got := histogram_percentiles(histogram); got != want {
+		t.Errorf("histogram_percentiles: got %+v, want %+v", got, want)
+	}
+
+	// 3 nodes in round 0, 6 in round 2 and 1 in round 5.
+	got := histogram_percentiles([]int{3, 0, 6, 0, 0, 1})
+	if want := (percentiles{p50: 2, p90: 2, p99: 5, max: 5}); got != want {
+		t.Errorf("histogram_percentiles: got %+v, want %+v", got, want)
+	}
+}
+
+// TestDistribution checks that the infection rounds agree with the infection
+// records in every mode, and that the last infection ends the run.
+func TestDistribution(t *testing.T) {
+	for _, mode := range testModes {
+		result := run_config(t, mode.name, mode.config(true, true), nil)
+		d := infection_distribution(result)
+
+		if int(d.rounds.max) != len(result.curve)-1 {
+			t.Errorf("%s: last infection in round %g, but the curve has %d rounds", mode.name, d.rounds.max, len(result.curve)-1)
+		}
+		if d.has_records != (result.infections != nil) {
+			t.Errorf("%s: has records %v with records %v", mode.name, d.has_records, result.infections != nil)
+		}
+		if d.has_records && d.elapsed.max > float64(result.duration) {
+			t.Errorf("%s: last infection at %gns, after the run took %v", mode.name, d.elapsed.max, result.duration)
+		}
+		if !mode.async && result.avg_rounds != float64(result.rounds) {
+			t.Errorf("%s: avg %g rounds, but every node ran all %d rounds", mode.name, result.avg_rounds, result.rounds)
+		}
+	}
+}
@@ -1,21 +1,116 @@
 package main
 
 import (
+	"context"
 	"math/rand"
-	"sync"
 	"time"
 )
 
-// StartGossip sets up the network and starts the gossip algorithms.
-func StartGossip(node_num int, infected_num int, should_push bool, should_pull bool, async bool, leader bool) (time.Duration, float64) {
+// GossipResult holds the measurements of a single gossip simulation.
+type GossipResult struct {
+	duration   time.Duration     // How long it took for the network to get infected.
+	avg_rounds float64           // The average number of rounds run by each node.
+	in_degrees []int             // The final view in-degree of each node, if peer sampling was used.
+	nodes      int               // The number of nodes.
+	infections []infectionRecord // How each node was infected, or nil if the engine does not record it.
+	curve      []int             // The number of infected nodes after each round, starting from round 0.
+	messages   []int64           // The number of messages sent in each round, starting from round 1.
+	rounds     int               // The number of completed rounds.
+	infected   int               // The number of infected nodes at the end.
+	converged  bool              // Whether the network got fully infected.
+	err        error             // Why the gossip stopped before converging, or nil.
+	stats      runtimeStats      // What the Go runtime did during the gossip.
+	time       float64           // The simulated time units until the gossip stopped, in the Poisson model.
+	node_stats []nodeStats       // What happened to each node, or nil if the engine does not record it.
+	pushes     int64             // The number of push messages sent.
+	pulls      int64             // The number of pull requests sent.
+	replies    int64             // The number of pull replies carrying the rumor.
+	dropped    int64             // The number of messages lost between groups of a partition.
+	heal_at    time.Duration     // When the partition healed, since the start of the gossip, or 0.
+	crashed    int               // The crashed nodes that were not infected at the end.
+	events     []scenarioOutcome // What the events of the scenario did.
+}
+
+// infected_fraction returns the fraction of nodes infected at the end.
+func (r GossipResult) infected_fraction() float64 {
+	if r.nodes == 0 {
+		return 0
+	}
+
+	return float64(r.infected) / float64(r.nodes)
+}
+
+// total_messages returns the number of messages sent in all rounds.
+func (r GossipResult) total_messages() int64 {
+	total := int64(0)
+	for _, m := range r.messages {
+		total += m
+	}
+
+	return total
+}
+
+// transmissions returns the number of messages that carried the rumor: the
+// pushes and the pull replies from nodes forwarding it.
+func (r GossipResult) transmissions() int64 {
+	return r.pushes + r.replies
+}
+
+// StartGossip sets up the network and starts the gossip algorithms. The gossip
+// stops early, with the partial state in the result, when ctx is done, the
+// configured timeout expires or the maximum number of rounds is reached. An
+// invalid configuration returns a *ConfigError without running.
+func StartGossip(ctx context.Context, config gossipConfig) (GossipResult, error) {
+	if err := config.validate(); err != nil {
+		return GossipResult{}, err
+	}
+
+	// Runs are only recorded while the metrics are served, so benchmarks do
+	// not pay for them.
+	m := current_metrics()
+	if m == nil {
+		return start_gossip(ctx, config), nil
+	}
+	run := m.start(config)
+	config.observer = run.chain(config.observer)
+	result := start_gossip(ctx, config)
+	run.finish(result)
+
+	return result, nil
+}
+
+// start_gossip runs the gossip of a valid config with its engine.
+func start_gossip(ctx context.Context, config gossipConfig) GossipResult {
+	node_num := config.node_num
+	infected_num := config.infected_num
+	leader := config.leader
 
-	rand.Seed(time.Now().UnixNano())
+	// Every engine draws from its own sources, seeded from seed, so that
+	// concurrent runs neither share nor reseed a random stream.
+	seed := config.seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	rng := rand.New(rand.NewSource(seed))
+
+	switch config.engine {
+	case enginePool:
+		return start_pool(ctx, config, seed)
+	case engineBitset:
+		return start_bitset(ctx, config, seed)
+	}
+	if config.median {
+		return start_median(ctx, config, seed)
+	}
+	if config.poisson_rate > 0 {
+		return start_poisson(ctx, config, seed)
+	}
 
 	// Create the channels for the nodes to communicate with.
 	channels := make([]Bichan, node_num)
 	for i := 0; i < node_num; i++ {
 		channels[i] = Bichan{
-			make(chan bool, 1000),
+			make(chan message, 1000),
 			make(chan int, 1),
 		}
 
@@ -27,42 +122,160 @@ func StartGossip(node_num int, infected_num int, should_push bool, should_pull b
 	// Set up the network with the specified settings.
 	network := &Network{
 		has_leader:   leader,
-		async:        !leader && async,
-		should_push:  should_push,
-		should_pull:  should_pull,
+		async:        !leader && config.async,
+		should_push:  config.should_push,
+		should_pull:  config.should_pull,
 		num_infected: infected_num,
 		saturated:    infected_num >= node_num,
+		ttl:          config.ttl,
+		max_age:      config.rumor_max_age(),
+		deadline:     int64(config.rumor_max_age()),
+		forwarders:   int64(infected_num),
+		partition:    config.partition,
+		heal_round:   config.heal_round,
+		events:       config.events,
+		stepper:      config.stepper,
+		max_rounds:   config.max_rounds,
 		channels:     channels,
+		states:       make([]uint32, node_num),
+		observer:     config.observer,
+		tracer:       config.tracer,
+		log:          new_logger("network"),
 	}
 
-	if leader {
-		network.w_phase = &sync.WaitGroup{}
-	} else {
-		network.w_phase = &BulkWaitGroup{}
+	if config.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.timeout)
+		defer cancel()
+	}
+	network.ctx, network.cancel = context.WithCancel(ctx)
+	defer network.cancel()
+
+	if !leader {
+		network.barrier = NewBarrier(node_num, config.barrier_timeout)
+	}
+
+	if config.view_size > 0 {
+		network.views = new_peer_views(node_num, config.view_size, rng)
+		network.shuffle_len = config.shuffle_len
+		if network.shuffle_len <= 0 {
+			network.shuffle_len = (config.view_size + 1) / 2
+		}
 	}
 
 	network.nodes = make([]Node, node_num)
 
-	// Add nodes to the network, and start their gossip algorithms.
+	var assignment []int
+	if config.classes != nil {
+		assignment = assign_classes(config.classes, node_num, rng)
+	}
+
+	// Add nodes to the network, and start their gossip algorithms. Node i
+	// draws from seed + i + 1.
 	for i := 0; i < node_num; i++ {
+		if i < infected_num {
+			network.states[i] = 1
+		}
+
 		network.nodes[i] = Node{
 			node_pos:   i,
-			infected:   i < infected_num,
 			stop_phase: make(chan struct{}),
 			network:    network,
+			record:     infectionRecord{from: -1, infected: i < infected_num},
+			log:        new_logger("node").for_node(i),
+			rng:        rand.New(rand.NewSource(seed + int64(i) + 1)),
+		}
+		if assignment != nil && assignment[i] >= 0 {
+			network.nodes[i].class = &config.classes[assignment[i]]
 		}
 	}
 
+	if network.tracer != nil {
+		network.tracer.begin(config)
+	}
+
 	// Time how long it takes for the entire network to get infected.
-	start_time := time.Now()
+	stats := start_stats()
+	network.start_time = time.Now()
 	network.Gossip()
-	duration := time.Since(start_time)
+	duration := time.Since(network.start_time)
+	runtime_stats := stats.finish()
+	if network.async {
+		network.stop_handlers()
+	}
+
+	if network.tracer != nil {
+		network.tracer.record(traceEvent{Kind: traceEnd, Round: len(network.round_messages), Sim: float64(len(network.round_messages)), From: -1, To: -1, Infected: network.infected_count()})
+	}
 
 	total_rounds := 0
-	for _, node := range network.nodes {
-		total_rounds += node.num_rounds
+	infections := make([]infectionRecord, node_num)
+	node_stats := make([]nodeStats, node_num)
+	for i := range network.nodes {
+		node := &network.nodes[i]
+		total_rounds += int(node.num_rounds)
+		infections[i] = node.record
+		node_stats[i] = nodeStats{class: -1, waited: node.waited, offline: node.offline_rounds, rounds: int(node.num_rounds)}
+		if assignment != nil {
+			node_stats[i].class = assignment[i]
+		}
+		if leader {
+			node_stats[i].rounds = network.round
+		}
 	}
 	avg_rounds := float64(total_rounds) / float64(node_num)
+	if leader {
+		// With a leader, every node runs every round the leader started.
+		avg_rounds = float64(network.round)
+	}
+
+	result := GossipResult{
+		duration:   duration,
+		avg_rounds: avg_rounds,
+		nodes:      node_num,
+		infections: infections,
+		curve:      infection_curve(infections),
+		messages:   network.round_messages,
+		rounds:     len(network.round_messages),
+		infected:   network.infected_count(),
+		err:        network.err,
+		stats:      runtime_stats,
+		node_stats: node_stats,
+		pushes:     network.pushes,
+		pulls:      network.pulls,
+		replies:    network.replies,
+		dropped:    network.dropped,
+		heal_at:    network.heal_at,
+		crashed:    network.crashed_susceptible,
+		events:     network.event_log,
+	}
+	result.converged = result.err == nil && result.infected+result.crashed >= node_num
+	if network.views != nil {
+		result.in_degrees = in_degrees(network.views)
+	}
+
+	return result
+}
+
+// infection_curve returns the number of infected nodes after each round,
+// starting with the initially infected nodes in round 0.
+func infection_curve(records []infectionRecord) []int {
+	last_round := 0
+	for _, r := range records {
+		if r.infected && r.round > last_round {
+			last_round = r.round
+		}
+	}
+
+	curve := make([]int, last_round+1)
+	for _, r := range records {
+		if r.infected {
+			curve[r.round] += 1
+		}
+	}
+	for i := 1; i < len(curve); i++ {
+		curve[i] += curve[i-1]
+	}
 
-	return duration, avg_rounds
+	return curve
 }
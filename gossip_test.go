@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestMain silences warnings, such as those of stopped runs, which the tests
+// provoke on purpose. The level is set once, since goroutines of async runs may
+// still be reading it when a test ends.
+func TestMain(m *testing.M) {
+	logs.level = levelError
+	os.Exit(m.Run())
+}
+
+// testNodes is the network size of the convergence tests. It is small enough
+// to run many times under the race detector, and large enough for the
+// theoretical bounds to be meaningful.
+const testNodes = 256
+
+// testMode is a network mode, as the flags that select it.
+type testMode struct {
+	name   string
+	async  bool
+	leader bool
+	engine string
+}
+
+// testModes are the network modes.
+var testModes = []testMode{
+	{"leader", false, true, ""},
+	{"sync", false, false, ""},
+	{"async", true, false, ""},
+	{"pool", false, false, enginePool},
+	{"bitset", false, false, engineBitset},
+}
+
+// testAlgorithms are the gossip algorithms with the expected number of rounds
+// to infect n nodes from a single node: log2 n + ln n for push (Pittel),
+// log2 n + ln ln n for pull, and log3 n + ln ln n for push-pull (Karp et al.).
+var testAlgorithms = []struct {
+	name     string
+	push     bool
+	pull     bool
+	expected func(n float64) float64
+}{
+	{"push", true, false, func(n float64) float64 { return math.Log2(n) + math.Log(n) }},
+	{"pull", false, true, func(n float64) float64 { return math.Log2(n) + math.Log(math.Log(n)) }},
+	{"pushpull", true, true, func(n float64) float64 { return math.Log(n)/math.Log(3) + math.Log(math.Log(n)) }},
+}
+
+// test_config returns the configuration of a test run in the network mode or
+// engine that mode selects, on testNodes nodes from a single infected node,
+// with seed 1 and a timeout of a minute. Tests change what they need.
+func test_config(mode gossipConfig, push bool, pull bool) gossipConfig {
+	config := mode
+	config.node_num = testNodes
+	config.infected_num = 1
+	config.should_push = push
+	config.should_pull = pull
+	config.timeout = time.Minute
+	config.seed = 1
+
+	return config
+}
+
+// config returns the configuration of a test run in the mode.
+func (mode testMode) config(push bool, pull bool) gossipConfig {
+	return test_config(gossipConfig{async: mode.async, leader: mode.leader, engine: mode.engine}, push, pull)
+}
+
+// run_config runs config, and fails the test, naming the run name, if the
+// config is invalid, or if the run did not stop with want, or infect every
+// node if want is nil.
+func run_config(t *testing.T, name string, config gossipConfig, want error) GossipResult {
+	t.Helper()
+
+	result, err := StartGossip(context.Background(), config)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	switch {
+	case want == nil && !result.converged:
+		t.Errorf("%s: did not converge: %v", name, result.err)
+	case !errors.Is(result.err, want):
+		t.Errorf("%s: stopped with %v, want %v", name, result.err, want)
+	}
+
+	return result
+}
+
+// TestConvergence runs every algorithm in every network mode with fixed seeds,
+// and checks that every node ends infected and that the mean number of rounds
+// is within the theoretical bounds. Async nodes count their own rounds, paced
+// by the clock rather than by each other, so under the race detector their
+// upper bound is much looser.
+func TestConvergence(t *testing.T) {
+	runs := 10
+	if testing.Short() {
+		runs = 3
+	}
+
+	for _, mode := range testModes {
+		for _, alg := range testAlgorithms {
+			mode, alg := mode, alg
+			t.Run(mode.name+"/"+alg.name, func(t *testing.T) {
+				total := 0
+				for seed := 1; seed <= runs; seed++ {
+					config := mode.config(alg.push, alg.pull)
+					config.seed = int64(seed)
+
+					result := run_config(t, fmt.Sprintf("seed %d", seed), config, nil)
+					check_converged(t, seed, result)
+					total += len(result.curve) - 1
+				}
+
+				mean := float64(total) / float64(runs)
+				expected := alg.expected(testNodes)
+				lo, hi := 0.7*expected, 1.5*expected
+				if mode.async && raceEnabled {
+					// The race detector slows the nodes down unevenly, and
+					// async nodes count their own rounds, so runs take up
+					// to about 9 times the expected rounds.
+					hi = 20 * expected
+				}
+				if mean < lo || mean > hi {
+					t.Errorf("mean of %.2f rounds is not within [%.2f, %.2f], expected %.2f", mean, lo, hi, expected)
+				}
+			})
+		}
+	}
+}
+
+// check_converged checks that every node of the result is infected.
+func check_converged(t *testing.T, seed int, result GossipResult) {
+	t.Helper()
+
+	if !result.converged || result.err != nil {
+		t.Fatalf("seed %d: did not converge: %v", seed, result.err)
+	}
+	if result.infected != testNodes {
+		t.Fatalf("seed %d: %d of %d nodes infected", seed, result.infected, testNodes)
+	}
+	for i, r := range result.infections {
+		if !r.infected {
+			t.Fatalf("seed %d: node %d is not infected", seed, i)
+		}
+	}
+	if last := result.curve[len(result.curve)-1]; last != testNodes {
+		t.Fatalf("seed %d: infection curve ends at %d of %d nodes", seed, last, testNodes)
+	}
+}
+
+// TestMaxRounds checks that the synchronous modes stop after the maximum
+// number of rounds with ErrMaxRounds and the partial state.
+func TestMaxRounds(t *testing.T) {
+	for _, mode := range testModes {
+		if mode.async {
+			continue
+		}
+
+		config := mode.config(true, false)
+		config.max_rounds = 2
+
+		result := run_config(t, mode.name, config, ErrMaxRounds)
+		if result.rounds != 2 {
+			t.Errorf("%s: completed %d rounds, want 2", mode.name, result.rounds)
+		}
+		if result.infected < 1 || result.infected > 4 {
+			t.Errorf("%s: %d nodes infected after 2 push rounds, want 1 to 4", mode.name, result.infected)
+		}
+	}
+}
+
+// TestCancel checks that every mode stops when its context is cancelled.
+func TestCancel(t *testing.T) {
+	for _, mode := range testModes {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		result, err := StartGossip(ctx, mode.config(true, false))
+		if err != nil {
+			t.Fatalf("%s: %v", mode.name, err)
+		}
+		if result.converged || !errors.Is(result.err, context.Canceled) {
+			t.Errorf("%s: got converged %v and error %v, want context.Canceled", mode.name, result.converged, result.err)
+		}
+	}
+}
+
+// TestMessageCounts checks that in every synchronous mode, each infected node
+// pushes and each susceptible node pulls once per round, and that every node
+// infected by pull got a reply, with a network size that does not fill the
+// last word of a bitset.
+func TestMessageCounts(t *testing.T) {
+	nodes := 1000
+
+	for _, mode := range testModes {
+		if mode.async {
+			continue
+		}
+
+		for _, alg := range testAlgorithms[:2] {
+			config := mode.config(alg.push, alg.pull)
+			config.node_num, config.infected_num = nodes, 3
+
+			result := run_config(t, mode.name+"/"+alg.name, config, nil)
+
+			if replies := int64(nodes - 3); alg.pull && result.replies != replies {
+				t.Errorf("%s/%s: %d replies, want %d", mode.name, alg.name, result.replies, replies)
+			}
+
+			for round := 1; round < len(result.curve); round++ {
+				want := int64(result.curve[round-1])
+				if alg.pull {
+					want = int64(nodes - result.curve[round-1])
+				}
+				if got := result.messages[round-1]; got != want {
+					t.Errorf("%s/%s: %d messages in round %d, want %d", mode.name, alg.name, got, round, want)
+				}
+			}
+		}
+	}
+}
+
+// TestSeed checks that a run of an engine whose outcome the goroutine
+// scheduling does not decide is reproducible from its seed, even while other
+// runs with other seeds go on at the same time, as the jobs of a server do.
+func TestSeed(t *testing.T) {
+	modes := map[string]gossipConfig{
+		"pool":    {engine: enginePool},
+		"bitset":  {engine: engineBitset},
+		"poisson": {poisson_rate: 1},
+		"median":  {median: true},
+	}
+	for name, mode := range modes {
+		config := test_config(mode, true, true)
+
+		want := run_seeds(t, config, 1)[0]
+		for i, got := range run_seeds(t, config, 1, 2, 1, 2, 1, 2) {
+			if got.seed == 1 && (!reflect.DeepEqual(got.curve, want.curve) || got.total_messages() != want.total_messages()) {
+				t.Errorf("%s: run %d infected %v with %d messages, want %v with %d",
+					name, i, got.curve, got.total_messages(), want.curve, want.total_messages())
+			}
+		}
+	}
+}
+
+// TestSeedClasses checks that the goroutine engine assigns the classes, and
+// takes its nodes offline, reproducibly from the seed, even while other runs
+// go on at the same time.
+func TestSeedClasses(t *testing.T) {
+	flaky := new_class("flaky")
+	flaky.share, flaky.online = 0.5, 0.5
+
+	config := testModes[0].config(true, false)
+	config.classes = []nodeClass{flaky}
+	config.max_rounds = 3
+
+	want := run_seeds(t, config, 1)[0]
+	for i, got := range run_seeds(t, config, 1, 2, 1, 2, 1, 2) {
+		if got.seed != 1 {
+			continue
+		}
+		for pos := range got.node_stats {
+			g, w := got.node_stats[pos], want.node_stats[pos]
+			if g.class != w.class || g.offline != w.offline {
+				t.Errorf("run %d: node %d has class %d and was offline %d rounds, want %d and %d", i, pos, g.class, g.offline, w.class, w.offline)
+			}
+		}
+	}
+}
+
+// seededResult is the result of a run with its seed.
+type seededResult struct {
+	GossipResult
+	seed int64
+}
+
+// run_seeds runs config with each of seeds at the same time, and returns the
+// results in the same order.
+func run_seeds(t *testing.T, config gossipConfig, seeds ...int64) []seededResult {
+	t.Helper()
+
+	results := make([]seededResult, len(seeds))
+	errs := make([]error, len(seeds))
+	var wg sync.WaitGroup
+	for i, seed := range seeds {
+		config.seed = seed
+		results[i].seed = seed
+		wg.Add(1)
+		go func(i int, config gossipConfig) {
+			defer wg.Done()
+			results[i].GossipResult, errs[i] = StartGossip(context.Background(), config)
+		}(i, config)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return results
+}
+
+// TestPoisson checks that the Poisson clock model infects every node in about
+// the expected time, which scales inversely with the rate.
+func TestPoisson(t *testing.T) {
+	runs := 20
+	if testing.Short() {
+		runs = 5
+	}
+
+	for _, alg := range testAlgorithms {
+		for _, rate := range []float64{1, 4} {
+			total := 0.0
+			for seed := 1; seed <= runs; seed++ {
+				config := test_config(gossipConfig{poisson_rate: rate}, alg.push, alg.pull)
+				config.seed = int64(seed)
+
+				result := run_config(t, alg.name, config, nil)
+				check_converged(t, seed, result)
+				total += result.time
+			}
+
+			mean := total / float64(runs)
+			expected := poisson_expected_time(alg.name, testNodes, rate)
+			if mean < 0.8*expected || mean > 1.4*expected {
+				t.Errorf("%s at rate %g: mean time %.3f is not within [%.3f, %.3f]", alg.name, rate, mean, 0.8*expected, 1.4*expected)
+			}
+		}
+	}
+}
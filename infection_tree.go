@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"time"
+)
+
+// infectionRecord records how a node became infected.
+type infectionRecord struct {
+	infected bool          // Whether the node was infected at all.
+	from     int           // The position of the infecting node, or -1 if initially infected.
+	round    int           // The round in which the node was infected.
+	pull     bool          // Whether the node pulled the infection, rather than it being pushed.
+	at       time.Duration // When the node was infected, since the start of the gossip.
+	time     float64       // When the node was infected in simulated time units, in the Poisson model.
+	hops     int           // The hops the rumor took to the node.
+}
+
+// mechanism returns how the node was infected: "initial", "push" or "pull",
+// or "none" if it was never infected.
+func (r infectionRecord) mechanism() string {
+	switch {
+	case !r.infected:
+		return "none"
+	case r.from < 0:
+		return "initial"
+	case r.pull:
+		return "pull"
+	default:
+		return "push"
+	}
+}
+
+// treeStats summarizes the shape of the infection tree. Initially infected
+// nodes are the roots, and each other node is a child of the node that
+// infected it.
+type treeStats struct {
+	depths       []int   // The depth of each node. Roots have depth 0.
+	children     []int   // The number of nodes each node infected.
+	max_depth    int     // The depth of the deepest node.
+	mean_depth   float64 // The mean depth over all nodes.
+	max_children int     // The most nodes infected by a single node.
+	branching    float64 // The mean number of children of nodes that infected anyone.
+	pushes       int     // The number of nodes infected by a push.
+	pulls        int     // The number of nodes infected by a pull.
+}
+
+// summarize_tree computes the depth and branching statistics of the tree. Nodes
+// that were never infected are not part of the tree, and have depth -1.
+func summarize_tree(records []infectionRecord) treeStats {
+	node_num := len(records)
+	stats := treeStats{
+		depths:   make([]int, node_num),
+		children: make([]int, node_num),
+	}
+
+	for i := range stats.depths {
+		stats.depths[i] = -1
+	}
+
+	// depth follows the chain of infecting nodes up to a root, memoizing the
+	// depths along the way.
+	var depth func(pos int) int
+	depth = func(pos int) int {
+		if stats.depths[pos] >= 0 || !records[pos].infected {
+			return stats.depths[pos]
+		}
+
+		if records[pos].from < 0 {
+			stats.depths[pos] = 0
+		} else {
+			stats.depths[pos] = depth(records[pos].from) + 1
+		}
+
+		return stats.depths[pos]
+	}
+
+	total_depth := 0
+	infected := 0
+	for i, r := range records {
+		if !r.infected {
+			continue
+		}
+
+		infected += 1
+		d := depth(i)
+		total_depth += d
+		if d > stats.max_depth {
+			stats.max_depth = d
+		}
+
+		if r.from >= 0 {
+			stats.children[r.from] += 1
+			if r.pull {
+				stats.pulls += 1
+			} else {
+				stats.pushes += 1
+			}
+		}
+	}
+
+	internal := 0
+	for _, c := range stats.children {
+		if c > 0 {
+			internal += 1
+		}
+		if c > stats.max_children {
+			stats.max_children = c
+		}
+	}
+
+	if infected > 0 {
+		stats.mean_depth = float64(total_depth) / float64(infected)
+	}
+	if internal > 0 {
+		stats.branching = float64(stats.pushes+stats.pulls) / float64(internal)
+	}
+
+	return stats
+}
+
+// write_tree_dot writes the infection tree to path in the Graphviz DOT format.
+// Pull edges are dashed, and point from the node that was pulled from.
+func write_tree_dot(path string, records []infectionRecord) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	fmt.Fprintln(w, "digraph infection {")
+	for i, r := range records {
+		if !r.infected {
+			fmt.Fprintf(w, "\t%d [style=dotted];\n", i)
+		} else if r.from < 0 {
+			fmt.Fprintf(w, "\t%d [shape=doublecircle];\n", i)
+		}
+	}
+	for i, r := range records {
+		if !r.infected || r.from < 0 {
+			continue
+		}
+
+		style := "solid"
+		if r.pull {
+			style = "dashed"
+		}
+		fmt.Fprintf(w, "\t%d -> %d [label=\"%d\", style=%s];\n", r.from, i, r.round, style)
+	}
+	fmt.Fprintln(w, "}")
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// write_tree_gexf writes the infection tree to path in the GEXF 1.2 format,
+// with the infection round, depth and mechanism as attributes.
+func write_tree_gexf(path string, records []infectionRecord) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stats := summarize_tree(records)
+
+	w := bufio.NewWriter(file)
+	fmt.Fprintln(w, `<?xml version="1.0" encoding="UTF-8"?>`)
+	fmt.Fprintln(w, `<gexf xmlns="http://www.gexf.net/1.2draft" version="1.2">`)
+	fmt.Fprintln(w, `  <graph defaultedgetype="directed">`)
+	fmt.Fprintln(w, `    <attributes class="node">`)
+	fmt.Fprintln(w, `      <attribute id="0" title="round" type="integer"/>`)
+	fmt.Fprintln(w, `      <attribute id="1" title="depth" type="integer"/>`)
+	fmt.Fprintln(w, `      <attribute id="2" title="mechanism" type="string"/>`)
+	fmt.Fprintln(w, `    </attributes>`)
+	fmt.Fprintln(w, `    <nodes>`)
+	for i, r := range records {
+		fmt.Fprintf(w, "      <node id=\"%d\" label=\"%d\">\n", i, i)
+		fmt.Fprintln(w, `        <attvalues>`)
+		fmt.Fprintf(w, "          <attvalue for=\"0\" value=\"%d\"/>\n", r.round)
+		fmt.Fprintf(w, "          <attvalue for=\"1\" value=\"%d\"/>\n", stats.depths[i])
+		fmt.Fprintf(w, "          <attvalue for=\"2\" value=\"%s\"/>\n", r.mechanism())
+		fmt.Fprintln(w, `        </attvalues>`)
+		fmt.Fprintln(w, `      </node>`)
+	}
+	fmt.Fprintln(w, `    </nodes>`)
+	fmt.Fprintln(w, `    <edges>`)
+	for i, r := range records {
+		if r.infected && r.from >= 0 {
+			fmt.Fprintf(w, "      <edge id=\"%d\" source=\"%d\" target=\"%d\" label=\"%s\"/>\n", i, r.from, i, r.mechanism())
+		}
+	}
+	fmt.Fprintln(w, `    </edges>`)
+	fmt.Fprintln(w, `  </graph>`)
+	fmt.Fprintln(w, `</gexf>`)
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
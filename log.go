@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logLevel is the severity of a log entry. Higher levels are more verbose.
+type logLevel int
+
+const (
+	levelError logLevel = iota
+	levelWarn
+	levelInfo
+	levelDebug
+	levelTrace
+)
+
+var levelNames = []string{"error", "warn", "info", "debug", "trace"}
+
+func (l logLevel) String() string {
+	return levelNames[l]
+}
+
+// parse_level returns the level with the given name.
+func parse_level(name string) (logLevel, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			return logLevel(i), nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+// logSink decides which entries are written, and writes them as text or JSON
+// lines to its output.
+type logSink struct {
+	level      logLevel            // The level of components without their own level.
+	components map[string]logLevel // The levels of individual components, or nil.
+	only       bool                // Whether components not in components are silenced.
+	nodes      []nodeRange         // The nodes to log for, or nil for all nodes.
+	json       bool                // Whether to write JSON lines instead of text.
+	out        io.Writer
+	start      time.Time
+	lock       sync.Mutex
+}
+
+// logs is the sink all loggers write to. It is configured once in main,
+// before any simulation starts.
+var logs = &logSink{level: levelWarn, out: os.Stdout, start: time.Now()}
+
+// enabled returns whether an entry of the component and node at level would be
+// written. Entries not about a node pass the node filter.
+func (s *logSink) enabled(component string, node int, level logLevel) bool {
+	max := s.level
+	if c, ok := s.components[component]; ok {
+		max = c
+	} else if s.only {
+		return false
+	}
+
+	if level > max {
+		return false
+	}
+
+	if node < 0 || s.nodes == nil {
+		return true
+	}
+	for _, r := range s.nodes {
+		if node >= r.lo && node <= r.hi {
+			return true
+		}
+	}
+
+	return false
+}
+
+// write formats and writes a single entry.
+func (s *logSink) write(level logLevel, component string, msg string, fields []interface{}) {
+	var b strings.Builder
+	elapsed := time.Since(s.start)
+
+	if s.json {
+		fmt.Fprintf(&b, `{"t":%q,"level":%q,"component":%q,"msg":%s`,
+			elapsed.String(), level.String(), component, json_value(msg))
+		for i := 0; i+1 < len(fields); i += 2 {
+			fmt.Fprintf(&b, ",%s:%s", json_value(fmt.Sprint(fields[i])), json_value(fields[i+1]))
+		}
+		b.WriteString("}\n")
+	} else {
+		fmt.Fprintf(&b, "%12s %-5s %-8s %s", elapsed, level, component, msg)
+		for i := 0; i+1 < len(fields); i += 2 {
+			fmt.Fprintf(&b, " %v=%v", fields[i], fields[i+1])
+		}
+		b.WriteString("\n")
+	}
+
+	s.lock.Lock()
+	io.WriteString(s.out, b.String())
+	s.lock.Unlock()
+}
+
+// json_value encodes v as JSON, falling back to its string form for values
+// that cannot be encoded.
+func json_value(v interface{}) string {
+	switch v := v.(type) {
+	case time.Duration:
+		return strconv.Quote(v.String())
+	case error:
+		return strconv.Quote(v.Error())
+	}
+
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return strconv.Quote(fmt.Sprint(v))
+	}
+
+	return string(encoded)
+}
+
+// logger writes entries for a named component, such as "node", "network",
+// "barrier" or "bench", with a set of key/value fields added to every entry.
+type logger struct {
+	component string
+	node      int           // The node the logger is for, or -1.
+	fields    []interface{} // Alternating keys and values.
+}
+
+// new_logger creates a logger for the component.
+func new_logger(component string) logger {
+	return logger{component: component, node: -1}
+}
+
+// for_node returns a logger that adds the node's position to every entry, and
+// is subject to node filtering.
+func (l logger) for_node(pos int) logger {
+	l = l.with("node", pos)
+	l.node = pos
+	return l
+}
+
+// with returns a logger that adds the key/value pairs to every entry.
+func (l logger) with(kv ...interface{}) logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	l.fields = append(append(fields, l.fields...), kv...)
+	return l
+}
+
+// enabled returns whether entries at level would be written.
+func (l logger) enabled(level logLevel) bool {
+	return logs.enabled(l.component, l.node, level)
+}
+
+// log writes msg with the logger's fields and the key/value pairs kv, if
+// level is enabled.
+func (l logger) log(level logLevel, msg string, kv ...interface{}) {
+	if !l.enabled(level) {
+		return
+	}
+
+	fields := l.fields
+	if len(kv) > 0 {
+		fields = append(append(make([]interface{}, 0, len(l.fields)+len(kv)), l.fields...), kv...)
+	}
+
+	logs.write(level, l.component, msg, fields)
+}
+
+func (l logger) error(msg string, kv ...interface{}) { l.log(levelError, msg, kv...) }
+func (l logger) warn(msg string, kv ...interface{})  { l.log(levelWarn, msg, kv...) }
+func (l logger) info(msg string, kv ...interface{})  { l.log(levelInfo, msg, kv...) }
+func (l logger) debug(msg string, kv ...interface{}) { l.log(levelDebug, msg, kv...) }
+func (l logger) trace(msg string, kv ...interface{}) { l.log(levelTrace, msg, kv...) }
+
+// parse_log_components parses a comma-separated list of components, each
+// optionally followed by "=level". Components without a level get the
+// default level.
+func parse_log_components(list string, default_level logLevel) (map[string]logLevel, error) {
+	components := map[string]logLevel{}
+
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		level := default_level
+		if i := strings.Index(item, "="); i >= 0 {
+			var err error
+			level, err = parse_level(item[i+1:])
+			if err != nil {
+				return nil, err
+			}
+			item = item[:i]
+		}
+
+		components[item] = level
+	}
+
+	return components, nil
+}
+
+// nodeRange is an inclusive range of node positions.
+type nodeRange struct {
+	lo int
+	hi int
+}
+
+// parse_node_ranges parses a comma-separated list of node positions and
+// ranges, such as "0,5,10-19", without expanding the ranges.
+func parse_node_ranges(list string) ([]nodeRange, error) {
+	ranges := []nodeRange{}
+
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		lo, hi, err := parse_range(item)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, nodeRange{lo, hi})
+	}
+
+	return ranges, nil
+}
+
+// parse_node_list parses a comma-separated list of node positions and ranges
+// of a network of node_num nodes into a set. A position beyond the network is
+// an error, found before its range is expanded.
+func parse_node_list(list string, node_num int) (map[int]bool, error) {
+	ranges, err := parse_node_ranges(list)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := map[int]bool{}
+	for _, r := range ranges {
+		if r.hi >= node_num {
+			return nil, fmt.Errorf("node %d is not between 0 and %d", r.hi, node_num-1)
+		}
+		for pos := r.lo; pos <= r.hi; pos++ {
+			nodes[pos] = true
+		}
+	}
+
+	return nodes, nil
+}
+
+// parse_range parses a single position "a" or an inclusive range "a-b".
+func parse_range(item string) (int, int, error) {
+	parts := strings.SplitN(item, "-", 2)
+
+	lo, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid node %q", item)
+	}
+	if len(parts) == 1 {
+		return lo, lo, nil
+	}
+
+	hi, err := strconv.Atoi(parts[1])
+	if err != nil || hi < lo {
+		return 0, 0, fmt.Errorf("invalid node range %q", item)
+	}
+
+	return lo, hi, nil
+}
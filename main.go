@@ -1,45 +1,42 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"math"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
 
 	"github.com/integrii/flaggy"
 )
 
-var verbosity = 0
-
-func dbgPrint(level int, a ...interface{}) (n int, err error) {
-	if verbosity >= level {
-		fmt.Println(a...)
-	}
-
-	return 0, nil
-}
-
-type gossipConfig struct {
-	node_num     int
-	infected_num int
-	should_push  bool
-	should_pull  bool
-	async        bool
-	leader       bool
-}
-
 type p struct{ a, b bool }
 
 func runBenchmark() {
-	configs := make([]gossipConfig, 0, 3*3*4*3)
+	configs := make([]gossipConfig, 0, 6*3*5*3)
 
-	//                                sync lead      async         sync nolead
-	for _, async_leader := range []p{{false, true}, {true, false}, {false, false}} {
+	//                                      sync lead       async          sync nolead  pool                    bitset                    poisson
+	for _, mode := range []gossipConfig{{leader: true}, {async: true}, {}, {engine: enginePool}, {engine: engineBitset}, {poisson_rate: 1}} {
 		//                             push           pull           pushpull
 		for _, push_pull := range []p{{true, false}, {false, true}, {true, true}} {
 			for i := 0; i <= 4; i++ {
 				node_num := 2 * int(math.Pow(8, float64(i)))
 				for j := 0; j <= 2; j++ {
 					infected_num := 1 + (j * node_num / 3)
-					configs = append(configs, gossipConfig{node_num, infected_num, push_pull.a, push_pull.b, async_leader.a, async_leader.b})
+					configs = append(configs, gossipConfig{
+						node_num:     node_num,
+						infected_num: infected_num,
+						should_push:  push_pull.a,
+						should_pull:  push_pull.b,
+						async:        mode.async,
+						leader:       mode.leader,
+						engine:       mode.engine,
+						poisson_rate: mode.poisson_rate,
+					})
 				}
 			}
 		}
@@ -51,37 +48,439 @@ func runBenchmark() {
 			if i == 0 {
 				node_num = 2
 			}
-			configs = append(configs, gossipConfig{node_num, 1, push_pull.a, push_pull.b, true, false})
+			configs = append(configs, gossipConfig{
+				node_num:     node_num,
+				infected_num: 1,
+				should_push:  push_pull.a,
+				should_pull:  push_pull.b,
+				async:        true,
+			})
 		}
 	}
 
-	fmt.Println(configs)
+	log := new_logger("bench")
+	log.info("start", "configs", len(configs))
 
 	for _, c := range configs {
 		for i := 0; i < 3; i++ {
-			alg := ""
-			var network string
+			log.debug("run", "algorithm", c.algorithm(), "network", c.network_mode(), "nodes", c.node_num, "infected", c.infected_num, "repetition", i)
+			result, err := StartGossip(context.Background(), c)
+			if err != nil {
+				log.error("invalid config", "error", err)
+				continue
+			}
 
-			dur, rounds := StartGossip(c.node_num, c.infected_num, c.should_push, c.should_pull, c.async, c.leader)
+			s := result.stats
+			r := infection_distribution(result).rounds
+			fmt.Printf("%s\t%s\t%d\t%d\t%f\t%f\t%d\t%f\t%d\t%f\t%f\t%g\t%g\t%g\t%g\t%d\n", c.algorithm(), c.network_mode(), c.node_num, c.infected_num, float64(result.duration.Microseconds())/1000.0, result.avg_rounds,
+				s.peak_goroutines, mebibytes(s.peak_heap), s.num_gc, float64(s.gc_pause.Microseconds())/1000.0, mebibytes(s.alloc_bytes),
+				r.p50, r.p90, r.p99, r.max, result.total_messages())
+		}
+	}
 
-			if c.should_push {
-				alg = "push"
+	compareMedian(log)
+}
+
+// compareMedian prints the rumor transmissions of plain push-pull, as the
+// pushpull command runs it with the pool engine, of the median-counter
+// algorithm and of aged push-pull on the same networks, one tab-separated line
+// per run. Plain push-pull stops once every node is infected, which no node
+// can tell, so in aged push-pull each node forwards the rumor for log2 n
+// rounds instead, and the run lasts until they all stopped.
+func compareMedian(log logger) {
+	for i := 1; i <= 6; i++ {
+		node_num := 2 * int(math.Pow(8, float64(i)))
+		for seed := int64(1); seed <= 3; seed++ {
+			plain := gossipConfig{node_num: node_num, infected_num: 1, should_push: true, should_pull: true, engine: enginePool, seed: seed}
+			median := gossipConfig{node_num: node_num, infected_num: 1, should_push: true, should_pull: true, median: true, seed: seed}
+			aged := plain
+			aged.max_age, aged.until_stopped = default_max_age(node_num), true
+
+			log.debug("compare", "nodes", node_num, "seed", seed)
+			results := []GossipResult{}
+			for _, config := range []gossipConfig{plain, median, aged} {
+				result, err := StartGossip(context.Background(), config)
+				if err != nil {
+					log.error("invalid config", "error", err)
+					break
+				}
+				results = append(results, result)
 			}
-			if c.should_pull {
-				alg += "pull"
+			if len(results) < 3 {
+				continue
 			}
+			p, m, a := results[0], results[1], results[2]
+
+			fmt.Printf("compare\t%d\t%d\t%d\t%d\t%f\t%d\t%d\t%d\t%t\n", node_num, p.transmissions(), m.transmissions(), a.transmissions(),
+				float64(m.transmissions())/float64(p.transmissions()), p.rounds, m.rounds, a.rounds, m.converged)
+		}
+	}
+}
+
+// The exit codes for invalid configurations, so scripts can tell the reasons
+// apart. Any other error exits with 1, and commandline parse errors with 2.
+var exitCodes = []struct {
+	err  error
+	code int
+}{
+	{ErrTooFewNodes, 10},
+	{ErrNoInitialInfection, 11},
+	{ErrTooManyInfected, 12},
+	{ErrNoAlgorithm, 13},
+	{ErrConflictingNetwork, 14},
+	{ErrInvalidOption, 15},
+}
+
+// exitInvalid prints why the configuration is invalid and exits with the exit
+// code of the reason.
+func exitInvalid(err error) {
+	fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
+
+	for _, e := range exitCodes {
+		if errors.Is(err, e.err) {
+			exit(e.code)
+		}
+	}
+	exit(1)
+}
+
+// commandProfiler profiles the whole command. Deferred calls do not run on
+// os.Exit, so exit stops it too.
+var commandProfiler *profiler
+
+// stop_profiling stops profiling the command, if it still is, and writes the
+// profiles.
+func stop_profiling() {
+	if commandProfiler == nil {
+		return
+	}
+
+	if err := commandProfiler.stop(); err != nil {
+		fmt.Println("Could not write the profiles:", err)
+	}
+	commandProfiler = nil
+}
+
+// exit writes the profiles and exits with code. Once profiling started, use it
+// instead of os.Exit.
+func exit(code int) {
+	stop_profiling()
+	os.Exit(code)
+}
+
+// setupLogging configures the log sink from the commandline options. -v logs
+// at the debug level and -vv at the trace level.
+func setupLogging(verbose bool, vverbose bool, level string, components string, nodes string, format string, file string) error {
+	switch {
+	case level != "":
+		l, err := parse_level(level)
+		if err != nil {
+			return err
+		}
+		logs.level = l
+	case vverbose:
+		logs.level = levelTrace
+	case verbose:
+		logs.level = levelDebug
+	}
+
+	if components != "" {
+		c, err := parse_log_components(components, logs.level)
+		if err != nil {
+			return err
+		}
+		logs.components = c
+		logs.only = true
+	}
+
+	if nodes != "" {
+		n, err := parse_node_ranges(nodes)
+		if err != nil {
+			return err
+		}
+		logs.nodes = n
+	}
+
+	switch format {
+	case "text":
+	case "json":
+		logs.json = true
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	if file != "" {
+		f, err := os.Create(file)
+		if err != nil {
+			return err
+		}
+		logs.out = f
+	}
+
+	return nil
+}
+
+// interruptContext returns a context that is cancelled on an interrupt, so that
+// a running simulation stops cleanly and reports its partial state.
+func interruptContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+
+	go func() {
+		select {
+		case <-interrupts:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(interrupts)
+		cancel()
+	}
+}
+
+// printViewReport prints the in-degree distribution of the partial views.
+func printViewReport(degrees []int) {
+	stats := summarize_degrees(degrees)
+	fmt.Printf("View in-degree: min %d, max %d, mean %.2f, stddev %.2f\n", stats.min, stats.max, stats.mean, stats.stddev)
+
+	for _, d := range stats.sorted_degrees() {
+		count := stats.histogram[d]
+		bar := count * 50 / len(degrees)
+		if bar == 0 {
+			bar = 1
+		}
+		fmt.Printf("%4d %6d %s\n", d, count, strings.Repeat("#", bar))
+	}
+}
+
+// printInfectionReport prints when the nodes became infected, and with
+// histogram, the number of nodes infected in each round.
+func printInfectionReport(result GossipResult, poisson bool, histogram bool) {
+	dist := infection_distribution(result)
+	r := dist.rounds
+	fmt.Printf("Infection round: p50 %g, p90 %g, p99 %g, last infection in round %g\n", r.p50, r.p90, r.p99, r.max)
+
+	if dist.has_records {
+		t := dist.elapsed.durations()
+		fmt.Printf("Infection time: p50 %v, p90 %v, p99 %v, max %v\n", t[0], t[1], t[2], t[3])
+		h := dist.hops
+		fmt.Printf("Hops: p50 %g, p90 %g, p99 %g, max %g\n", h.p50, h.p90, h.p99, h.max)
+	}
+	if dist.has_records && poisson {
+		s := dist.sim_time
+		fmt.Printf("Simulated infection time: p50 %.3f, p90 %.3f, p99 %.3f, max %.3f\n", s.p50, s.p90, s.p99, s.max)
+	}
+
+	if !histogram {
+		return
+	}
+	for round, count := range dist.histogram {
+		bar := count * 50 / result.infected
+		if bar == 0 && count > 0 {
+			bar = 1
+		}
+		fmt.Printf("%4d %6d %s\n", round, count, strings.Repeat("#", bar))
+	}
+}
+
+// printClassReport prints how the nodes of each class fared. Without a
+// leader, it also prints how long they waited at the barrier for stragglers.
+func printClassReport(config gossipConfig, result GossipResult) {
+	barrier := !config.leader && !config.async
+	for _, s := range summarize_classes(config.classes, result) {
+		fmt.Printf("Class %s: %d nodes, %d infected, infection round p50 %g, max %g, offline %.1f%% of rounds",
+			s.name, s.nodes, s.infected, s.rounds.p50, s.rounds.max, 100*s.offline)
+		if barrier {
+			fmt.Printf(", barrier wait %v per round", s.wait.Round(time.Microsecond))
+		}
+		fmt.Println()
+	}
+}
+
+// printPartitionReport prints how far the rumor spread in each group of the
+// partition, and how long the network took to converge after the heal.
+func printPartitionReport(config gossipConfig, result GossipResult) {
+	heal := config.heal_round
+	for g, s := range summarize_partition(config.partition, heal, result) {
+		if s.nodes == 0 {
+			continue
+		}
+		fmt.Printf("Partition %d (from node %d): %d nodes, %d infected", g, s.first, s.nodes, s.infected)
+		if heal > 0 {
+			fmt.Printf(", %d by the heal", s.at_heal)
+		}
+		if s.infected == s.nodes {
+			fmt.Printf(", all by round %d", s.last_round)
+		}
+		fmt.Println()
+	}
+	fmt.Printf("Dropped %d messages between partitions\n", result.dropped)
+
+	switch {
+	case heal == 0:
+		fmt.Println("The partition never healed")
+	case result.rounds <= heal:
+		fmt.Printf("The gossip ended before the heal at the end of round %d\n", heal)
+	case result.converged:
+		rounds, elapsed := heal_convergence(heal, result)
+		fmt.Printf("Converged %d rounds and %v after the heal at the end of round %d\n", rounds, elapsed, heal)
+	default:
+		fmt.Printf("Did not converge after the heal at the end of round %d\n", heal)
+	}
+}
+
+// scenarioMaxRounds is the number of rounds after which a scenario gives up
+// without --max-rounds, --timeout or max_rounds in the file, since crashes and
+// partitions may keep it from ever converging.
+const scenarioMaxRounds = 1000
+
+// printScenarioReport prints what each event of the scenario did, and the
+// events that never happened because the gossip stopped first.
+func printScenarioReport(config gossipConfig, result GossipResult) {
+	for _, o := range result.events {
+		fmt.Printf("Round %d: %s", o.round, o.event)
+		switch o.event.action {
+		case eventCrash:
+			fmt.Printf(", %d nodes crashed", o.count)
+		case eventRecover:
+			fmt.Printf(", %d nodes recovered", o.count)
+		case eventInject:
+			fmt.Printf(", %d nodes injected", o.count)
+		case eventPartition:
+			fmt.Printf(", %d groups", o.count)
+		}
+		fmt.Printf(", %d of %d nodes infected\n", o.infected, result.nodes)
+	}
+	for _, e := range config.events[len(result.events):] {
+		fmt.Printf("Round %d: %s did not happen\n", e.round, e)
+	}
+
+	if result.crashed > 0 {
+		fmt.Printf("%d crashed nodes were never infected\n", result.crashed)
+	}
+	if result.dropped > 0 {
+		fmt.Printf("Dropped %d messages between partitions or to loss\n", result.dropped)
+	}
+}
+
+// printTTLSweep runs config with every TTL from 1 to max_ttl, and prints the
+// maximum age the nodes forward the rumor for, then the coverage, rounds and
+// messages of each.
+func printTTLSweep(ctx context.Context, config gossipConfig, max_ttl int) error {
+	config.ttl = 1
+	if config.max_age == 0 {
+		fmt.Printf("Nodes forward the rumor for %d rounds (log2 n, without --max-age)\n", config.rumor_max_age())
+	} else {
+		fmt.Printf("Nodes forward the rumor for %d rounds\n", config.rumor_max_age())
+	}
+
+	for ttl := 1; ttl <= max_ttl; ttl++ {
+		config.ttl = ttl
+		result, err := StartGossip(ctx, config)
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		fmt.Printf("TTL %d: %d of %d nodes infected (%.1f%%) in %d rounds with %d messages\n",
+			ttl, result.infected, result.nodes, 100*result.infected_fraction(), result.rounds, result.total_messages())
+	}
+
+	return nil
+}
+
+// printTreeReport prints the depth and branching statistics of the infection
+// tree.
+func printTreeReport(records []infectionRecord) {
+	stats := summarize_tree(records)
+	fmt.Printf("Infection tree: max depth %d, mean depth %.2f, max children %d, mean branching %.2f\n",
+		stats.max_depth, stats.mean_depth, stats.max_children, stats.branching)
+	fmt.Printf("Infected by push: %d, by pull: %d\n", stats.pushes, stats.pulls)
+
+	per_depth := make([]int, stats.max_depth+1)
+	for _, d := range stats.depths {
+		per_depth[d] += 1
+	}
+	for d, count := range per_depth {
+		fmt.Printf("%4d %6d\n", d, count)
+	}
+}
+
+// runReplay reads the trace at path and prints a summary of each round. If
+// step is set, it also prints each round's events and waits for enter.
+func runReplay(path string, step bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	events, err := read_trace(file)
+	if err != nil {
+		return err
+	}
 
-			if c.async {
-				network = "async"
-			} else if !c.leader {
-				network = "sync"
-			} else {
-				network = "leader"
+	config := events[0]
+	fmt.Printf("Replaying %s on a %s network of %d nodes, %d initially infected, from %d events\n",
+		config.Algorithm, config.Network, config.Nodes, config.Infected, len(events))
+
+	stdin := bufio.NewReader(os.Stdin)
+	fmt.Println("round\tpush\trequest\treply\treceived\tinfected\ttotal")
+	for _, r := range replay_trace(events) {
+		if step {
+			for _, e := range r.events {
+				fmt.Println(format_event(e))
 			}
+		}
 
-			fmt.Printf("%s\t%s\t%d\t%d\t%f\t%f\n", alg, network, c.node_num, c.infected_num, float64(dur.Microseconds())/1000.0, rounds)
+		fmt.Printf("%d\t%d\t%d\t%d\t%d\t%d\t%d\n", r.round, r.sends[tracePush], r.sends[traceRequest],
+			r.sends[traceReply], r.receives, r.infections, r.infected)
+
+		if step {
+			fmt.Print("Press enter to continue...")
+			if _, err := stdin.ReadString('\n'); err != nil {
+				fmt.Println()
+				step = false
+			}
 		}
 	}
+
+	last := events[len(events)-1]
+	if last.Kind == traceEnd {
+		fmt.Printf("Run ended after %d rounds and %v with %d of %d nodes infected\n",
+			last.Round, time.Duration(last.Time), last.Infected, config.Nodes)
+	} else {
+		fmt.Println("Trace ended before the run finished")
+	}
+
+	return nil
+}
+
+// printAggregateReport prints the estimation error in each round of an
+// aggregation run, and the final estimates.
+func printAggregateReport(function string, result AggregateResult) {
+	fmt.Println("round\tmax error\tmean error")
+	for i, round := range result.rounds {
+		fmt.Printf("%d\t%g\t%g\n", i+1, round.max_error, round.mean_error)
+	}
+
+	lo, hi := result.estimates[0], result.estimates[0]
+	for _, e := range result.estimates {
+		lo = math.Min(lo, e)
+		hi = math.Max(hi, e)
+	}
+
+	status := "converged"
+	if !result.converged {
+		status = "did not converge"
+	}
+	fmt.Printf("Computing %s took %v and %d rounds (%s): true %g, estimates in [%g, %g]\n",
+		function, result.duration, len(result.rounds), status, result.truth, lo, hi)
 }
 
 func main() {
@@ -89,8 +488,53 @@ func main() {
 	infected_num := 1
 	async := false
 	leader := false
+	engine := engineGoroutine
+	poisson_rate := 0.0
+	view_size := 0
+	shuffle_len := 0
+	classes_spec := ""
+	classes_file := ""
+	trace_path := ""
+	replay_path := ""
+	replay_step := false
+	scenario_path := ""
+	repl_algorithm := "pushpull"
+	serve_addr := "127.0.0.1:8080"
+	serve_queue := 16
+	serve_workers := 2
+	serve_retain := 100
+	serve_max_nodes := 1000000
+	compare_old := ""
+	compare_new := ""
+	compare_alpha := 0.05
+	compare_min_change := 0.05
+	tui := false
+	barrier_timeout := time.Duration(0)
+	max_rounds := 0
+	ttl := 0
+	max_age := 0
+	sweep_ttl := 0
+	partition_spec := ""
+	heal_round := 0
+	timeout := time.Duration(0)
+	seed := int64(0)
+	report := ""
+	tree := false
+	histogram := false
+	tree_dot := ""
+	tree_gexf := ""
+	agg_function := aggAverage
+	agg_tolerance := 0.001
+	agg_rounds := 1000
 	verbose := false
 	vverbose := false
+	log_level := ""
+	log_components := ""
+	log_nodes := ""
+	log_format := "text"
+	log_file := ""
+	profile := profileOptions{}
+	metrics_addr := ""
 
 	benchmark := flaggy.NewSubcommand("bench")
 	benchmark.Description = "Benchmark multiple configurations."
@@ -104,6 +548,43 @@ func main() {
 	pushpull_alg := flaggy.NewSubcommand("pushpull")
 	pushpull_alg.Description = "In each round, each infected node attempts to infect one random node. Then, each susceptible node attempts to retrieve infection from one random node."
 
+	median_alg := flaggy.NewSubcommand("median")
+	median_alg.Description = "The push-pull of Karp et al. with age counters, in which nodes stop spreading O(log log n) rounds after most nodes know the rumor."
+
+	aggregate := flaggy.NewSubcommand("aggregate")
+	aggregate.Description = "Each node starts with a random value, and the network computes an aggregate with push-sum or extreme propagation."
+	aggregate.String(&agg_function, "f", "function", "Sets the aggregate to compute: avg, sum, count, min or max.")
+	aggregate.Float64(&agg_tolerance, "t", "tolerance", "Stops once every node's relative error is at most this.")
+	aggregate.Int(&agg_rounds, "r", "rounds", "Sets the maximum number of rounds to run.")
+
+	replay := flaggy.NewSubcommand("replay")
+	replay.Description = "Reconstruct and summarize a run from its trace file."
+	replay.AddPositionalValue(&replay_path, "trace", 1, true, "The trace file written with --trace.")
+	replay.Bool(&replay_step, "", "step", "Print the events of each round, and wait for enter before the next.")
+
+	run := flaggy.NewSubcommand("run")
+	run.Description = "Run the algorithm of a scenario file with a leader, applying its timed events between rounds."
+	run.AddPositionalValue(&scenario_path, "scenario", 1, true, "The JSON scenario file.")
+
+	repl := flaggy.NewSubcommand("repl")
+	repl.Description = "Step through a gossip with a leader one phase or round at a time, inspecting and changing the nodes."
+	repl.String(&repl_algorithm, "", "algorithm", "Sets the algorithm: push, pull or pushpull.")
+
+	compare := flaggy.NewSubcommand("compare")
+	compare.Description = "Compare two outputs of bench, and exit with 3 if a configuration got significantly worse."
+	compare.AddPositionalValue(&compare_old, "old", 1, true, "The output of bench before the change.")
+	compare.AddPositionalValue(&compare_new, "new", 2, true, "The output of bench after the change.")
+	compare.Float64(&compare_alpha, "", "alpha", "Sets the significance level of Welch's t-test.")
+	compare.Float64(&compare_min_change, "", "min-change", "Sets the smallest relative change of a mean that counts, such as 0.05 for 5%.")
+
+	serve := flaggy.NewSubcommand("serve")
+	serve.Description = "Serve an HTTP JSON API to submit simulations, follow their progress and fetch their results."
+	serve.String(&serve_addr, "", "addr", "Sets the address to listen on.")
+	serve.Int(&serve_queue, "", "queue", "Sets the number of jobs that may wait for a worker.")
+	serve.Int(&serve_workers, "", "workers", "Sets the number of jobs that run at the same time.")
+	serve.Int(&serve_retain, "", "retain", "Sets the number of finished jobs kept, forgetting the oldest.")
+	serve.Int(&serve_max_nodes, "", "max-nodes", "Sets the most nodes a job may have.")
+
 	flaggy.SetName("gogossip")
 	flaggy.SetDescription("Gossip simulator")
 
@@ -111,13 +592,53 @@ func main() {
 	flaggy.Int(&infected_num, "i", "infected", "Sets the number of initially infected nodes in the network.")
 	flaggy.Bool(&async, "a", "async", "Use an asynchronous network.")
 	flaggy.Bool(&leader, "l", "leader", "Use a synchronous network with a leader.")
+	flaggy.String(&engine, "", "engine", "Sets how a synchronous network is run: goroutine for a goroutine per node, pool for a worker per CPU over shards of nodes, or bitset for one bit per node.")
+	flaggy.Float64(&poisson_rate, "", "poisson", "Use an asynchronous network in which each node gossips at the ticks of its own Poisson clock of this rate, and report simulated time.")
+	flaggy.Int(&view_size, "k", "view", "Use peer sampling with a partial view of this size instead of global membership.")
+	flaggy.Int(&shuffle_len, "s", "shuffle", "Sets the number of view entries exchanged per shuffle, or 0 for half the view.")
+	flaggy.String(&classes_spec, "", "classes", "Split the nodes into classes by share, such as \"server=0.8,fanout=2;edge=0.2,delay=5ms,online=0.7\".")
+	flaggy.String(&classes_file, "", "classes-file", "Read the node classes from this JSON file, which may also assign classes to specific nodes.")
+	flaggy.String(&trace_path, "", "trace", "Record every message, infection and phase to this file as JSON lines.")
+	flaggy.Int(&ttl, "", "ttl", "Stop forwarding the rumor after it took this many hops. Without --max-age, nodes then forward it for log2 n rounds. (default: no limit)")
+	flaggy.Int(&max_age, "", "max-age", "Let each node forward the rumor for only this many rounds after getting it. (default: no limit, or log2 n with --ttl)")
+	flaggy.Int(&sweep_ttl, "", "sweep-ttl", "Run the configuration with every TTL from 1 to this, and print the coverage of each.")
+	flaggy.String(&partition_spec, "", "partition", "Split the nodes into groups that cannot reach each other, by fraction such as \"0.5;0.3\" or by nodes such as \"0-49;50-99\".")
+	flaggy.Int(&heal_round, "", "heal", "Heal the partition after this round. (default: never)")
+	flaggy.Int(&max_rounds, "", "max-rounds", "Give up if the network is not fully infected after this many rounds. (default: no limit)")
+	flaggy.Duration(&timeout, "", "timeout", "Give up if the network is not fully infected after this long, such as 30s. (default: no limit)")
+	flaggy.Duration(&barrier_timeout, "", "barrier-timeout", "Without a leader, stop if a phase takes longer than this, listing the nodes that never arrived. (default: no timeout)")
+	flaggy.Int64(&seed, "", "seed", "Seed the random peer selection with this, to make runs comparable. (default: seeded from the clock)")
+	flaggy.Bool(&tui, "", "tui", "Show a live dashboard of the simulation, updated each round.")
+	flaggy.String(&report, "", "report", "Write a standalone HTML report of the run to this file.")
+	flaggy.Bool(&histogram, "", "histogram", "Print the number of nodes infected in each round.")
+	flaggy.Bool(&tree, "", "tree", "Print depth and branching statistics of the infection tree.")
+	flaggy.String(&tree_dot, "", "dot", "Write the infection tree to this file in the DOT format.")
+	flaggy.String(&tree_gexf, "", "gexf", "Write the infection tree to this file in the GEXF format.")
 	flaggy.Bool(&verbose, "v", "verbose", "Print additional transmission information for debugging.")
 	flaggy.Bool(&vverbose, "vv", "vverbose", "Print more transmission information for debugging.")
+	flaggy.String(&log_level, "", "log-level", "Sets the log level: error, warn, info, debug or trace. Overrides -v and -vv.")
+	flaggy.String(&log_components, "", "log-components", "Only log these comma-separated components (node, network, barrier, bench, server), each optionally as component=level.")
+	flaggy.String(&log_nodes, "", "log-nodes", "Only log node entries for these comma-separated nodes or ranges, such as 0,5,10-19.")
+	flaggy.String(&log_format, "", "log-format", "Sets the log format: text or json.")
+	flaggy.String(&log_file, "", "log-file", "Write the log to this file instead of standard output.")
+	flaggy.String(&profile.cpu, "", "cpuprofile", "Write a CPU profile to this file.")
+	flaggy.String(&profile.mem, "", "memprofile", "Write a heap profile to this file when done.")
+	flaggy.String(&profile.block, "", "blockprofile", "Write a goroutine blocking profile to this file when done.")
+	flaggy.String(&profile.mutex, "", "mutexprofile", "Write a mutex contention profile to this file when done.")
+	flaggy.String(&profile.trace, "", "exec-trace", "Write a Go execution trace to this file.")
+	flaggy.String(&metrics_addr, "", "metrics-addr", "Serve Prometheus metrics of the simulations at /metrics on this address while running.")
 
 	flaggy.AttachSubcommand(benchmark, 1)
 	flaggy.AttachSubcommand(push_alg, 1)
 	flaggy.AttachSubcommand(pull_alg, 1)
 	flaggy.AttachSubcommand(pushpull_alg, 1)
+	flaggy.AttachSubcommand(median_alg, 1)
+	flaggy.AttachSubcommand(aggregate, 1)
+	flaggy.AttachSubcommand(replay, 1)
+	flaggy.AttachSubcommand(run, 1)
+	flaggy.AttachSubcommand(repl, 1)
+	flaggy.AttachSubcommand(serve, 1)
+	flaggy.AttachSubcommand(compare, 1)
 
 	flaggy.DefaultParser.DisableShowVersionWithVersion()
 	err := flaggy.DefaultParser.Parse()
@@ -125,11 +646,22 @@ func main() {
 		flaggy.ShowHelpAndExit(fmt.Sprintf("%v", err))
 	}
 
-	if verbose {
-		verbosity = 1
+	if err := setupLogging(verbose, vverbose, log_level, log_components, log_nodes, log_format, log_file); err != nil {
+		flaggy.ShowHelpAndExit(fmt.Sprintf("%v", err))
 	}
-	if vverbose {
-		verbosity = 2
+
+	commandProfiler, err = start_profiling(profile)
+	if err != nil {
+		fmt.Println("Could not start profiling:", err)
+		os.Exit(1)
+	}
+	defer stop_profiling()
+
+	if metrics_addr != "" {
+		if err := serve_metrics(metrics_addr); err != nil {
+			fmt.Println("Could not serve the metrics:", err)
+			exit(1)
+		}
 	}
 
 	if benchmark.Used {
@@ -137,17 +669,264 @@ func main() {
 		return
 	}
 
-	should_push := push_alg.Used || pushpull_alg.Used
-	should_pull := pull_alg.Used || pushpull_alg.Used
+	if replay.Used {
+		if err := runReplay(replay_path, replay_step); err != nil {
+			fmt.Println("Could not replay the trace:", err)
+			exit(1)
+		}
+		return
+	}
+
+	if compare.Used {
+		regressions, err := runCompare(compare_old, compare_new, compare_alpha, compare_min_change, os.Stdout)
+		if err != nil {
+			var config_err *ConfigError
+			if errors.As(err, &config_err) {
+				exitInvalid(err)
+			}
+			fmt.Println("Could not compare:", err)
+			exit(1)
+		}
+		if regressions > 0 {
+			exit(exitRegression)
+		}
+		return
+	}
+
+	if serve.Used {
+		ctx, stop := interruptContext()
+		defer stop()
+
+		limits := serverLimits{queue: serve_queue, retain: serve_retain, max_nodes: serve_max_nodes}
+		if err := runServer(ctx, serve_addr, serve_workers, limits); err != nil {
+			var config_err *ConfigError
+			if errors.As(err, &config_err) {
+				exitInvalid(err)
+			}
+			fmt.Println("Could not serve:", err)
+			exit(1)
+		}
+		return
+	}
+
+	if aggregate.Used {
+		config := gossipConfig{
+			node_num:    node_num,
+			view_size:   view_size,
+			shuffle_len: shuffle_len,
+			seed:        seed,
+		}
+
+		result, err := StartAggregate(config, agg_function, agg_tolerance, agg_rounds)
+		if err != nil {
+			exitInvalid(err)
+		}
+		printAggregateReport(agg_function, result)
+		return
+	}
+
+	should_push := push_alg.Used || pushpull_alg.Used || median_alg.Used
+	should_pull := pull_alg.Used || pushpull_alg.Used || median_alg.Used
+
+	if repl.Used {
+		if repl_algorithm != "push" && repl_algorithm != "pull" && repl_algorithm != "pushpull" {
+			exitInvalid(&ConfigError{"--algorithm", repl_algorithm, "use push, pull or pushpull", ErrNoAlgorithm})
+		}
+		should_push = repl_algorithm != "pull"
+		should_pull = repl_algorithm != "push"
+		leader = !async
+	}
+
+	var events []scenarioEvent
+	if run.Used {
+		s, err := read_scenario(scenario_path, node_num)
+		if err != nil {
+			exitInvalid(&ConfigError{"run", scenario_path, err.Error(), ErrInvalidOption})
+		}
+		should_push = s.algorithm != "pull"
+		should_pull = s.algorithm != "push"
+		leader = !async
+		if s.nodes > 0 {
+			node_num = s.nodes
+		}
+		if s.infected > 0 {
+			infected_num = s.infected
+		}
+		if s.max_rounds > 0 {
+			max_rounds = s.max_rounds
+		}
+		if max_rounds == 0 && timeout == 0 {
+			max_rounds = scenarioMaxRounds
+		}
+		if s.seed != 0 {
+			seed = s.seed
+		}
+		events = s.events
+	}
 
 	if !should_push && !should_pull {
-		flaggy.ShowHelpAndExit("")
+		flaggy.ShowHelp("")
+		exit(2)
+	}
+
+	config := gossipConfig{
+		node_num:     node_num,
+		infected_num: infected_num,
+		should_push:  should_push,
+		should_pull:  should_pull,
+		median:       median_alg.Used,
+		async:        async,
+		leader:       leader,
+		engine:       engine,
+		poisson_rate: poisson_rate,
+		view_size:    view_size,
+		shuffle_len:  shuffle_len,
+
+		ttl:             ttl,
+		max_age:         max_age,
+		heal_round:      heal_round,
+		events:          events,
+		barrier_timeout: barrier_timeout,
+		max_rounds:      max_rounds,
+		timeout:         timeout,
+		seed:            seed,
+	}
+	if classes_spec != "" && classes_file != "" {
+		exitInvalid(&ConfigError{"--classes", classes_spec, "--classes and --classes-file cannot be used together", ErrInvalidOption})
+	}
+	if classes_spec != "" {
+		config.classes, err = parse_classes(classes_spec)
+		if err != nil {
+			exitInvalid(&ConfigError{"--classes", classes_spec, err.Error(), ErrInvalidOption})
+		}
+	}
+	if classes_file != "" {
+		config.classes, err = read_classes(classes_file)
+		if err != nil {
+			exitInvalid(&ConfigError{"--classes-file", classes_file, err.Error(), ErrInvalidOption})
+		}
+	}
+	if partition_spec != "" {
+		config.partition, err = parse_partition(partition_spec, node_num)
+		if err != nil {
+			exitInvalid(&ConfigError{"--partition", partition_spec, err.Error(), ErrInvalidOption})
+		}
+	}
+	if err := config.validate(); err != nil {
+		exitInvalid(err)
 	}
+	if engine == engineBitset && (tree || tree_dot != "" || tree_gexf != "") {
+		exitInvalid(&ConfigError{"--tree", true, "the bitset engine does not record who infected each node", ErrInvalidOption})
+	}
+	if engine == engineBitset && tui {
+		exitInvalid(&ConfigError{"--tui", true, "the bitset engine has no per-node state to show", ErrInvalidOption})
+	}
+	if repl.Used {
+		if tui || sweep_ttl > 0 {
+			exitInvalid(&ConfigError{"repl", "with --tui or --sweep-ttl", "the REPL steps through a single run on the terminal", ErrInvalidOption})
+		}
 
-	if leader {
-		async = false
+		ctx, stop := interruptContext()
+		defer stop()
+
+		if err := runRepl(ctx, config, os.Stdin, os.Stdout); err != nil {
+			exitInvalid(err)
+		}
+		return
+	}
+	if sweep_ttl < 0 {
+		exitInvalid(&ConfigError{"--sweep-ttl", sweep_ttl, "need at least 1 TTL", ErrInvalidOption})
 	}
+	if sweep_ttl > 0 && (tui || trace_path != "" || report != "") {
+		exitInvalid(&ConfigError{"--sweep-ttl", sweep_ttl, "a sweep runs many times, and cannot be used with --tui, --trace or --report", ErrInvalidOption})
+	}
+	if sweep_ttl > 0 {
+		ctx, stop := interruptContext()
+		defer stop()
 
-	dur, avg_rounds := StartGossip(node_num, infected_num, should_push, should_pull, async, leader)
-	fmt.Println("Infecting", node_num, "nodes took", dur, "and avg", avg_rounds, "rounds")
+		if err := printTTLSweep(ctx, config, sweep_ttl); err != nil {
+			exitInvalid(err)
+		}
+		return
+	}
+	if tui {
+		config.observer = new_dashboard(os.Stdout, node_num).observe
+	}
+	if trace_path != "" {
+		t, err := new_tracer(trace_path)
+		if err != nil {
+			flaggy.ShowHelp(fmt.Sprintf("%v", err))
+			exit(2)
+		}
+		config.tracer = t
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+
+	result, err := StartGossip(ctx, config)
+	if err != nil {
+		exitInvalid(err)
+	}
+	config.observer = nil
+	if config.tracer != nil {
+		if err := config.tracer.Close(); err != nil {
+			fmt.Println("Could not write the trace:", err)
+		}
+		config.tracer = nil
+	}
+	if result.converged && poisson_rate > 0 {
+		expected := poisson_expected_time(config.algorithm(), node_num, poisson_rate)
+		fmt.Printf("Infecting %d nodes took %.3f time units at rate %g (%.2f times the expected %.3f), %v and avg %.2f ticks\n",
+			node_num, result.time, poisson_rate, result.time/expected, expected, result.duration, result.avg_rounds)
+	} else if result.converged {
+		fmt.Println("Infecting", node_num, "nodes took", result.duration, "and avg", result.avg_rounds, "rounds")
+	} else {
+		fmt.Printf("Did not converge: %v\n", result.err)
+		fmt.Printf("Completed %d rounds in %v with %d of %d nodes infected (%.1f%%)\n",
+			result.rounds, result.duration, result.infected, node_num, 100*result.infected_fraction())
+	}
+	printInfectionReport(result, poisson_rate > 0, histogram)
+	if config.classes != nil {
+		printClassReport(config, result)
+	}
+	if config.partition != nil {
+		printPartitionReport(config, result)
+	}
+	if config.events != nil {
+		printScenarioReport(config, result)
+	}
+	fmt.Println("Runtime:", result.stats)
+
+	if report != "" {
+		if err := write_report(report, config, result); err != nil {
+			fmt.Println("Could not write the report:", err)
+		}
+	}
+
+	if tree || tree_dot != "" || tree_gexf != "" {
+		printTreeReport(result.infections)
+	}
+	if tree_dot != "" {
+		if err := write_tree_dot(tree_dot, result.infections); err != nil {
+			fmt.Println("Could not write the infection tree:", err)
+		}
+	}
+	if tree_gexf != "" {
+		if err := write_tree_gexf(tree_gexf, result.infections); err != nil {
+			fmt.Println("Could not write the infection tree:", err)
+		}
+	}
+
+	if view_size > 0 {
+		printViewReport(result.in_degrees)
+
+		// Run the same configuration with uniform peer selection to compare the
+		// spread speed.
+		uniform, err := StartGossip(ctx, config.uniform())
+		if err != nil {
+			exitInvalid(err)
+		}
+		fmt.Println("With uniform selection, infecting took", uniform.duration, "and avg", uniform.avg_rounds, "rounds")
+	}
 }
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// The states of a node in the median-counter algorithm.
+const (
+	medianSusceptible = iota // State A: the node does not know the rumor.
+	medianCounting           // State B: the node spreads the rumor and counts its age.
+	medianClosing            // State C: the node spreads the rumor for a last few rounds.
+	medianDone               // State D: the node knows the rumor and no longer spreads it.
+)
+
+// medianModel simulates the median-counter push-pull algorithm of Karp,
+// Schindelhauer, Shenker and Vöcking (Randomized Rumor Spreading, 2000). In
+// each round, every node calls a random node, and each side of the call that
+// is spreading the rumor sends it to the other. A node in state B has a
+// counter, which it increments when most of the nodes in state B it exchanged
+// the rumor with have a counter at least as high. At ctr_max, or when it hears
+// from a node in state C, it moves to state C, spreads for ctr_max more rounds
+// and stops. A node also moves to state C when it sends the rumor to a node
+// that already stopped, so a node left counting among stopped nodes stops
+// too. Since nodes stop spreading about log log n rounds after most
+// nodes know the rumor, it transmits the rumor O(n log log n) times instead of
+// the O(n log n) of plain push-pull, and the gossip ends without knowing when
+// the network is fully infected. Every call still counts as a pull request.
+//
+// The nodes run in a single goroutine, and every round sees the states at its
+// start.
+type medianModel struct {
+	network  *Network
+	node_num int
+	ctr_max  int
+	rng      *rand.Rand
+	records  []infectionRecord
+	state    []uint8 // The state of each node.
+	counter  []int   // The counter of each node in state B, or its rounds in state C.
+	higher   []int   // The contacts in state B with a counter at least as high in this round.
+	lower    []int   // The contacts in state B with a lower counter in this round.
+	closing  []bool  // Whether a contact was in state C in this round.
+	told     []int   // Who first sent the rumor to a susceptible node in this round, or -1.
+	pulled   []bool  // Whether told answered a call of the node.
+}
+
+// median_ctr_max returns the counter at which nodes of a network of n nodes
+// move to state C, and the rounds they spend in it: ln ln n, but at least 3.
+// With 2, the rumor dies out before reaching every node in a few percent of
+// the runs.
+func median_ctr_max(n int) int {
+	c := int(math.Ceil(math.Log(math.Log(float64(n)))))
+	if c < 3 {
+		c = 3
+	}
+
+	return c
+}
+
+// spreading returns whether the node in state s sends the rumor.
+func spreading(s uint8) bool {
+	return s == medianCounting || s == medianClosing
+}
+
+// exchange lets from send the rumor to to, if from spreads it.
+func (m *medianModel) exchange(from int, to int, pull bool) {
+	n := m.network
+	if !spreading(m.state[from]) {
+		return
+	}
+
+	if pull {
+		n.replies += 1
+		n.trace(traceSend, n.round, from, to, traceReply)
+	} else {
+		n.pushes += 1
+		n.trace(traceSend, n.round, from, to, tracePush)
+	}
+
+	switch {
+	case m.state[to] == medianDone:
+		// The rumor is old for to, so from learns it is too.
+		m.closing[from] = true
+	case m.state[from] == medianClosing:
+		m.closing[to] = true
+	case m.counter[from] >= m.counter[to]:
+		m.higher[to] += 1
+	default:
+		m.lower[to] += 1
+	}
+
+	if m.state[to] == medianSusceptible && m.told[to] < 0 {
+		m.told[to] = from
+		m.pulled[to] = pull
+	}
+}
+
+// update moves pos to its state for the next round, from what it heard in
+// this round, and resets its contacts. It returns whether pos still spreads
+// the rumor.
+func (m *medianModel) update(pos int) bool {
+	n := m.network
+
+	switch m.state[pos] {
+	case medianSusceptible:
+		if m.told[pos] >= 0 {
+			m.state[pos] = medianCounting
+			m.counter[pos] = 1
+			if m.closing[pos] {
+				m.state[pos] = medianClosing
+				m.counter[pos] = 0
+			}
+
+			hops := n.hops(m.told[pos]) + 1
+			n.states[pos] = uint32(hops) + 1
+			n.num_infected += 1
+			m.records[pos] = infectionRecord{
+				infected: true,
+				from:     m.told[pos],
+				round:    n.round,
+				pull:     m.pulled[pos],
+				at:       time.Since(n.start_time),
+				hops:     hops,
+			}
+			n.trace(traceInfect, n.round, m.told[pos], pos, m.records[pos].mechanism())
+		}
+	case medianCounting:
+		if m.higher[pos] > m.lower[pos] {
+			m.counter[pos] += 1
+		}
+		if m.closing[pos] || m.counter[pos] >= m.ctr_max {
+			m.state[pos] = medianClosing
+			m.counter[pos] = 0
+		}
+	case medianClosing:
+		m.counter[pos] += 1
+		if m.counter[pos] >= m.ctr_max {
+			m.state[pos] = medianDone
+		}
+	}
+
+	m.higher[pos], m.lower[pos], m.closing[pos], m.told[pos] = 0, 0, false, -1
+
+	return spreading(m.state[pos])
+}
+
+// Gossip runs rounds until no node spreads the rumor any more, the gossip is
+// stopped or the maximum number of rounds is reached.
+func (m *medianModel) Gossip() {
+	n := m.network
+
+	for {
+		if err := n.ctx.Err(); err != nil {
+			n.fail(err)
+			return
+		}
+
+		n.round += 1
+		for pos := 0; pos < m.node_num; pos++ {
+			peer := m.rng.Intn(m.node_num - 1)
+			if peer >= pos {
+				peer += 1
+			}
+
+			// The call is a pull request, whether or not the peer replies.
+			n.pulls += 1
+			n.trace(traceSend, n.round, pos, peer, traceRequest)
+			if !n.reachable(pos, peer, n.round) {
+				n.drop(n.round, pos, peer, traceRequest)
+				continue
+			}
+			m.exchange(pos, peer, false)
+			m.exchange(peer, pos, true)
+		}
+
+		active := false
+		for pos := 0; pos < m.node_num; pos++ {
+			if m.update(pos) {
+				active = true
+			}
+		}
+		n.saturated = n.num_infected >= m.node_num
+
+		n.trace(tracePhase, n.round, -1, -1, "round end")
+		n.notify_round(n.round)
+
+		if !active {
+			if !n.saturated {
+				n.fail(ErrStoppedSpreading)
+			}
+			return
+		}
+		if n.max_rounds > 0 && n.round >= n.max_rounds {
+			n.fail(ErrMaxRounds)
+			return
+		}
+	}
+}
+
+// start_median runs the gossip of config with the median-counter algorithm.
+// Like the Poisson model, it runs in a single goroutine, and is reproducible
+// from its seed.
+func start_median(ctx context.Context, config gossipConfig, seed int64) GossipResult {
+	node_num := config.node_num
+
+	network := &Network{
+		has_leader:   true,
+		should_push:  true,
+		should_pull:  true,
+		num_infected: config.infected_num,
+		max_rounds:   config.max_rounds,
+		partition:    config.partition,
+		heal_round:   config.heal_round,
+		states:       make([]uint32, node_num),
+		observer:     config.observer,
+		tracer:       config.tracer,
+		log:          new_logger("network"),
+	}
+
+	if config.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.timeout)
+		defer cancel()
+	}
+	network.ctx, network.cancel = context.WithCancel(ctx)
+	defer network.cancel()
+
+	model := &medianModel{
+		network:  network,
+		node_num: node_num,
+		ctr_max:  median_ctr_max(node_num),
+		rng:      rand.New(rand.NewSource(seed)),
+		records:  make([]infectionRecord, node_num),
+		state:    make([]uint8, node_num),
+		counter:  make([]int, node_num),
+		higher:   make([]int, node_num),
+		lower:    make([]int, node_num),
+		closing:  make([]bool, node_num),
+		told:     make([]int, node_num),
+		pulled:   make([]bool, node_num),
+	}
+	for i := range model.records {
+		model.records[i] = infectionRecord{from: -1, infected: i < config.infected_num}
+		model.told[i] = -1
+		if i < config.infected_num {
+			network.states[i] = 1
+			model.state[i] = medianCounting
+			model.counter[i] = 1
+		}
+	}
+	network.log.debug("median counter", "ctr_max", model.ctr_max)
+
+	if network.tracer != nil {
+		network.tracer.begin(config)
+	}
+
+	stats := start_stats()
+	network.start_time = time.Now()
+	model.Gossip()
+	duration := time.Since(network.start_time)
+	runtime_stats := stats.finish()
+
+	if network.tracer != nil {
+		network.tracer.record(traceEvent{Kind: traceEnd, Round: len(network.round_messages), Sim: float64(len(network.round_messages)), From: -1, To: -1, Infected: network.num_infected})
+	}
+
+	result := GossipResult{
+		duration:   duration,
+		avg_rounds: float64(len(network.round_messages)),
+		nodes:      node_num,
+		infections: model.records,
+		curve:      infection_curve(model.records),
+		messages:   network.round_messages,
+		rounds:     len(network.round_messages),
+		infected:   network.num_infected,
+		err:        network.err,
+		stats:      runtime_stats,
+		pushes:     network.pushes,
+		pulls:      network.pulls,
+		replies:    network.replies,
+		dropped:    network.dropped,
+		heal_at:    network.heal_at,
+	}
+	result.converged = result.err == nil && result.infected >= node_num
+
+	return result
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+// TestMedian checks that the median-counter algorithm infects every node and
+// stops by itself, reproducibly from the seed, with a pull request from every
+// node in every round, and that on a large network it transmits the rumor
+// fewer times per node than aged push-pull, in which nodes forward it for
+// log2 n rounds since they cannot tell when to stop. Plain push-pull stops
+// once every node is infected, which takes knowledge no node has, so it is
+// not the one to beat.
+func TestMedian(t *testing.T) {
+	for _, node_num := range []int{testNodes, 64 * testNodes} {
+		per_node, aged_per_node := 0.0, 0.0
+		for seed := int64(1); seed <= 5; seed++ {
+			name := fmt.Sprintf("%d nodes, seed %d", node_num, seed)
+			config := test_config(gossipConfig{median: true}, true, true)
+			config.node_num, config.seed = node_num, seed
+
+			result := run_config(t, name, config, nil)
+			if want := int64(node_num * result.rounds); result.pulls != want {
+				t.Errorf("%d nodes, seed %d: %d pull requests in %d rounds, want %d", node_num, seed, result.pulls, result.rounds, want)
+			}
+
+			again, _ := StartGossip(context.Background(), config)
+			if again.total_messages() != result.total_messages() || again.rounds != result.rounds {
+				t.Errorf("%d nodes, seed %d: rerun sent %d messages in %d rounds, want %d in %d",
+					node_num, seed, again.total_messages(), again.rounds, result.total_messages(), result.rounds)
+			}
+			per_node += float64(result.transmissions()) / float64(node_num) / 5
+
+			aged := test_config(gossipConfig{engine: enginePool, until_stopped: true}, true, true)
+			aged.node_num, aged.max_age, aged.seed = node_num, default_max_age(node_num), seed
+			aged_result := run_config(t, name+", aged push-pull", aged, nil)
+			aged_per_node += float64(aged_result.transmissions()) / float64(node_num) / 5
+		}
+
+		// The median-counter algorithm wins only once log log n is well below
+		// log n.
+		if node_num > testNodes && per_node >= aged_per_node {
+			t.Errorf("%d nodes: %.2f transmissions per node, want fewer than the %.2f of aged push-pull", node_num, per_node, aged_per_node)
+		}
+	}
+}
+
+// TestMedianStops checks that a node left spreading among nodes that stopped
+// stops too, so the gossip ends even when the rumor cannot reach every node.
+func TestMedianStops(t *testing.T) {
+	m := &medianModel{
+		network:  &Network{states: make([]uint32, 3), log: new_logger("network")},
+		node_num: 3,
+		ctr_max:  3,
+		state:    []uint8{medianCounting, medianDone, medianDone},
+		counter:  []int{1, 0, 0},
+		higher:   make([]int, 3),
+		lower:    make([]int, 3),
+		closing:  make([]bool, 3),
+		told:     []int{-1, -1, -1},
+		pulled:   make([]bool, 3),
+	}
+
+	m.exchange(0, 1, false)
+	m.update(0)
+	if m.state[0] != medianClosing {
+		t.Errorf("node in state %d after pushing to a stopped node, want %d", m.state[0], medianClosing)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// gossipMetrics holds the *metrics collecting every run of the process, for
+// the /metrics endpoint, once enable_metrics was called. Until then it holds
+// none. Runs load it while it may be stored, so it is an atomic.Value.
+var gossipMetrics atomic.Value
+
+// metricsLock serializes enable_metrics.
+var metricsLock sync.Mutex
+
+// current_metrics returns the metrics recording every run, or nil.
+func current_metrics() *metrics {
+	m, _ := gossipMetrics.Load().(*metrics)
+	return m
+}
+
+// enable_metrics starts recording every run of the process, and returns the
+// metrics. Call it before starting any run.
+func enable_metrics() *metrics {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+
+	m := current_metrics()
+	if m == nil {
+		m = new_metrics()
+		gossipMetrics.Store(m)
+	}
+
+	return m
+}
+
+// metricsKey is the labels of a series of metrics.
+type metricsKey struct {
+	algorithm string
+	network   string
+}
+
+// metricsSeries is the metrics of the runs with the same labels.
+type metricsSeries struct {
+	runs     int64 // The runs started.
+	running  int64 // The runs in progress.
+	infected int64 // The nodes infected, including the initially infected ones.
+	rounds   int64 // The rounds completed.
+	pushes   int64 // The push messages sent.
+	pulls    int64 // The pull requests sent.
+	replies  int64 // The pull replies carrying the rumor.
+	dropped  int64 // The messages dropped between groups of a partition or lost.
+	wait_ns  int64 // How long nodes waited at the barrier.
+}
+
+// metrics holds a series of metrics per algorithm and network mode.
+type metrics struct {
+	lock   sync.Mutex
+	series map[metricsKey]*metricsSeries
+}
+
+// new_metrics returns metrics without any series.
+func new_metrics() *metrics {
+	return &metrics{series: map[metricsKey]*metricsSeries{}}
+}
+
+// metricsRun adds the progress of a run to its series. It keeps the totals it
+// added, since the network counts from the start of the run.
+type metricsRun struct {
+	m      *metrics
+	series *metricsSeries
+	added  metricsSeries
+}
+
+// start starts recording a run of config.
+func (m *metrics) start(config gossipConfig) *metricsRun {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	key := metricsKey{config.algorithm(), config.network_mode()}
+	s := m.series[key]
+	if s == nil {
+		s = &metricsSeries{}
+		m.series[key] = s
+	}
+	s.runs += 1
+	s.running += 1
+
+	return &metricsRun{m: m, series: s}
+}
+
+// add adds the difference between the totals of the run and what was already
+// added to the series.
+func (r *metricsRun) add(totals metricsSeries) {
+	r.m.lock.Lock()
+	defer r.m.lock.Unlock()
+
+	s := r.series
+	s.infected += totals.infected - r.added.infected
+	s.rounds += totals.rounds - r.added.rounds
+	s.pushes += totals.pushes - r.added.pushes
+	s.pulls += totals.pulls - r.added.pulls
+	s.replies += totals.replies - r.added.replies
+	s.dropped += totals.dropped - r.added.dropped
+	s.wait_ns += totals.wait_ns - r.added.wait_ns
+	r.added = totals
+}
+
+// observe records the progress of the run at the end of a round. It can be
+// used as a RoundObserver.
+func (r *metricsRun) observe(n *Network, round int) {
+	r.add(metricsSeries{
+		infected: int64(n.infected_count()),
+		rounds:   int64(round),
+		pushes:   atomic.LoadInt64(&n.pushes),
+		pulls:    atomic.LoadInt64(&n.pulls),
+		replies:  atomic.LoadInt64(&n.replies),
+		dropped:  atomic.LoadInt64(&n.dropped),
+		wait_ns:  atomic.LoadInt64(&n.wait_ns),
+	})
+}
+
+// chain returns an observer that calls observer, if any, and then records the
+// progress of the run.
+func (r *metricsRun) chain(observer RoundObserver) RoundObserver {
+	if observer == nil {
+		return r.observe
+	}
+
+	return func(n *Network, round int) {
+		observer(n, round)
+		r.observe(n, round)
+	}
+}
+
+// finish records the totals of the finished run.
+func (r *metricsRun) finish(result GossipResult) {
+	waited := time.Duration(0)
+	for _, stats := range result.node_stats {
+		waited += stats.waited
+	}
+
+	r.add(metricsSeries{
+		infected: int64(result.infected),
+		rounds:   int64(result.rounds),
+		pushes:   result.pushes,
+		pulls:    result.pulls,
+		replies:  result.replies,
+		dropped:  result.dropped,
+		wait_ns:  int64(waited),
+	})
+
+	r.m.lock.Lock()
+	r.series.running -= 1
+	r.m.lock.Unlock()
+}
+
+// metricsHelp describes each metric of a series.
+var metricsHelp = []struct {
+	name  string
+	kind  string
+	help  string
+	value func(s *metricsSeries) string
+}{
+	{"gogossip_runs_total", "counter", "The simulations started.", func(s *metricsSeries) string { return fmt.Sprint(s.runs) }},
+	{"gogossip_running", "gauge", "The simulations in progress.", func(s *metricsSeries) string { return fmt.Sprint(s.running) }},
+	{"gogossip_infected_nodes_total", "counter", "The nodes infected, including the initially infected ones.", func(s *metricsSeries) string { return fmt.Sprint(s.infected) }},
+	{"gogossip_rounds_total", "counter", "The rounds completed.", func(s *metricsSeries) string { return fmt.Sprint(s.rounds) }},
+	{"gogossip_dropped_messages_total", "counter", "The messages dropped between groups of a partition or lost.", func(s *metricsSeries) string { return fmt.Sprint(s.dropped) }},
+	{"gogossip_barrier_wait_seconds_total", "counter", "How long nodes waited at the barrier without a leader.", func(s *metricsSeries) string {
+		return fmt.Sprint(time.Duration(s.wait_ns).Seconds())
+	}},
+}
+
+// write writes the metrics in the Prometheus text exposition format.
+func (m *metrics) write(w io.Writer) {
+	m.lock.Lock()
+	keys := make([]metricsKey, 0, len(m.series))
+	series := make(map[metricsKey]metricsSeries, len(m.series))
+	for key, s := range m.series {
+		keys = append(keys, key)
+		series[key] = *s
+	}
+	m.lock.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].algorithm != keys[j].algorithm {
+			return keys[i].algorithm < keys[j].algorithm
+		}
+		return keys[i].network < keys[j].network
+	})
+	labels := func(key metricsKey) string {
+		return fmt.Sprintf("algorithm=%q,network=%q", key.algorithm, key.network)
+	}
+
+	for _, metric := range metricsHelp {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind)
+		for _, key := range keys {
+			s := series[key]
+			fmt.Fprintf(w, "%s{%s} %s\n", metric.name, labels(key), metric.value(&s))
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP gogossip_messages_total The messages sent, by type.\n# TYPE gogossip_messages_total counter\n")
+	for _, key := range keys {
+		s := series[key]
+		fmt.Fprintf(w, "gogossip_messages_total{%s,type=\"push\"} %d\n", labels(key), s.pushes)
+		fmt.Fprintf(w, "gogossip_messages_total{%s,type=\"pull\"} %d\n", labels(key), s.pulls)
+		fmt.Fprintf(w, "gogossip_messages_total{%s,type=\"reply\"} %d\n", labels(key), s.replies)
+	}
+
+	fmt.Fprintf(w, "# HELP gogossip_goroutines The goroutines of the process.\n# TYPE gogossip_goroutines gauge\n")
+	fmt.Fprintf(w, "gogossip_goroutines %d\n", runtime.NumGoroutine())
+}
+
+// ServeHTTP serves the metrics for a Prometheus scrape.
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.write(w)
+}
+
+// serve_metrics serves the metrics on addr at /metrics in the background, for
+// as long as the process runs.
+func serve_metrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", enable_metrics())
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go http.Serve(listener, mux)
+
+	return nil
+}
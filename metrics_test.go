@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// use_metrics records the runs of the test in new metrics, and returns them.
+// The metrics of the process are restored when the test ends, so the other
+// tests run as they would on their own.
+func use_metrics(t *testing.T) *metrics {
+	previous := current_metrics()
+	t.Cleanup(func() {
+		gossipMetrics.Store(previous)
+	})
+
+	m := new_metrics()
+	gossipMetrics.Store(m)
+
+	return m
+}
+
+// TestMetrics records a leader gossip and a bitset gossip through StartGossip,
+// and checks that they were added to their series, while the observer of the
+// run still sees every round.
+func TestMetrics(t *testing.T) {
+	m := use_metrics(t)
+	for _, mode := range []testMode{testModes[0], testModes[4]} {
+		config := mode.config(true, false)
+		key := metricsKey{"push", config.network_mode()}
+		observed := 0
+		config.observer = func(n *Network, round int) { observed += 1 }
+
+		result := run_config(t, mode.name, config, nil)
+		if observed != result.rounds {
+			t.Errorf("%s: observed %d of %d rounds", mode.name, observed, result.rounds)
+		}
+
+		m.lock.Lock()
+		s := *m.series[key]
+		m.lock.Unlock()
+		if s.runs != 1 || s.running != 0 || s.infected != int64(result.infected) ||
+			s.rounds != int64(result.rounds) || s.pushes != result.pushes || s.pulls != 0 {
+			t.Errorf("%s: got %+v for result %+v", mode.name, s, result)
+		}
+	}
+
+	// The infected nodes of runs at the same time add up.
+	run_seeds(t, testModes[0].config(false, true), 1, 2, 3, 4)
+	m.lock.Lock()
+	s := *m.series[metricsKey{"pull", "leader"}]
+	m.lock.Unlock()
+	if s.runs != 4 || s.infected != 4*testNodes || s.replies != 4*(testNodes-1) {
+		t.Errorf("got %d runs with %d infected nodes and %d replies, want 4 with %d and %d", s.runs, s.infected, s.replies, 4*testNodes, 4*(testNodes-1))
+	}
+
+	var out bytes.Buffer
+	m.write(&out)
+	for _, want := range []string{
+		"# TYPE gogossip_rounds_total counter\n",
+		`gogossip_runs_total{algorithm="push",network="bitset"} `,
+		`gogossip_infected_nodes_total{algorithm="push",network="leader"} 256`,
+		`gogossip_messages_total{algorithm="push",network="leader",type="pull"} 0`,
+		`gogossip_messages_total{algorithm="pull",network="leader",type="reply"} 1020`,
+		"gogossip_goroutines ",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output is missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+// TestServerMetrics checks that the job server serves the metrics of the
+// process.
+func TestServerMetrics(t *testing.T) {
+	use_metrics(t)
+	server := httptest.NewServer(new_job_server(context.Background(), serverLimits{queue: 1, retain: 1, max_nodes: 1000}).handler())
+	defer server.Close()
+
+	response, err := server.Client().Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(response.Header.Get("Content-Type"), "text/plain") || !strings.Contains(string(body), "gogossip_goroutines ") {
+		t.Errorf("got %s:\n%s", response.Header.Get("Content-Type"), body)
+	}
+}
+
+// TestMetricsDisabled checks that runs are not recorded while no metrics are
+// served, whatever the tests before did.
+func TestMetricsDisabled(t *testing.T) {
+	if current_metrics() != nil {
+		t.Fatal("the metrics of a test are still enabled")
+	}
+}
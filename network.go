@@ -1,40 +1,106 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Bichan struct {
-	set chan bool // Set an infected value.
-	req chan int  // Node at position is requesting the infected status.
+	set chan message // Set an infected value.
+	req chan int     // Node at position is requesting the infected status.
 }
 
-type WaitGroupLike interface {
-	Add(delta int)
-	Done()
-	Wait()
+// ErrMaxRounds is the reason the gossip stopped when the network was not
+// fully infected within the maximum number of rounds.
+var ErrMaxRounds = errors.New("maximum number of rounds reached")
+
+// ErrStoppedSpreading is the reason the gossip stopped when every node stopped
+// forwarding the rumor before the network was fully infected, because of its
+// age or hop count, or in the median-counter algorithm.
+var ErrStoppedSpreading = errors.New("every node stopped spreading before the network was fully infected")
+
+// message is an infection status sent from one node to another.
+type message struct {
+	infected bool // Whether the sender is infected.
+	from     int  // The position of the sender.
+	pull     bool // Whether the message answers a pull request.
+	hops     int  // The hops the rumor will have taken to the receiver.
 }
 
-// Type guards
-var _ WaitGroupLike = &BulkWaitGroup{}
-var _ WaitGroupLike = &sync.WaitGroup{}
+// RoundObserver is called at the end of each round with the current round. It
+// may be called while other nodes already run the next round, so it should
+// only read the network through its atomic counters and states.
+type RoundObserver func(n *Network, round int)
+
+// PhaseObserver is called by the leader at the start of each round, before
+// each of its phases and at its end, with no phase running. It may block, to
+// step through the gossip.
+type PhaseObserver func(n *Network, round int, phase string)
 
 type Network struct {
 	has_leader bool // Whether this network has a leader.
 	async      bool // Whether the network is asynchronous.
 
+	round      int       // The current round, if the network has a leader.
+	start_time time.Time // When the gossip started.
+
 	should_push bool // Whether nodes are allowed to push infected status.
 	should_pull bool // Whether nodes are allowed to pull infected status.
 
-	num_infected int          // Guarded by lock. The number of currently infected nodes.
-	saturated    bool         // Guarded by lock. Whether the network is fully infected.
-	lock         sync.RWMutex // The mutex to guard num_infected and saturated.
+	num_infected        int          // Guarded by lock. The number of currently infected nodes.
+	crashed_susceptible int          // Guarded by lock. The crashed nodes that are not infected, which the network converges without.
+	saturated           bool         // Guarded by lock. Whether the network is fully infected.
+	lock                sync.RWMutex // The mutex to guard num_infected, crashed_susceptible and saturated.
+
+	views       []PeerView // The partial views of the nodes, or nil to use global membership.
+	shuffle_len int        // The number of view entries exchanged in each shuffle.
+
+	pushes   int64         // Accessed atomically. The number of push messages sent.
+	pulls    int64         // Accessed atomically. The number of pull requests sent.
+	replies  int64         // Accessed atomically. The number of pull replies carrying the rumor.
+	wait_ns  int64         // Accessed atomically. How long all nodes waited at the barrier, in nanoseconds.
+	states   []uint32      // Accessed atomically. 0 for a susceptible node, or 1 + the hops the rumor took to it.
+	observer RoundObserver // Notified at the end of each round, or nil.
+	stepper  PhaseObserver // Notified between the phases of the leader, or nil.
+
+	tracer   *tracer  // Records the events of the gossip, or nil.
+	sim_time *float64 // In the Poisson model, the time of the last tick, which traced events carry. Otherwise nil.
+	log      logger   // The logger for the network's entries.
+
+	round_messages []int64 // The number of messages sent in each round.
+	last_messages  int64   // The number of messages sent by the end of the last round.
 
 	nodes    []Node         // The nodes in the network.
 	channels []Bichan       // The communication channels between nodes.
 	w        sync.WaitGroup // The completion WaitGroup.
-	w_phase  WaitGroupLike  // The phase synchronizer.
+	w_phase  sync.WaitGroup // The phase synchronizer, if the network has a leader.
+	barrier  *Barrier       // The phase synchronizer, if the network has no leader.
+	handlers sync.WaitGroup // The message handlers of async nodes, which outlive their node's gossip.
+
+	ttl        int   // The most hops the rumor is forwarded, or 0 for no limit.
+	max_age    int   // The most rounds a node forwards the rumor after getting it, or 0 for no limit.
+	deadline   int64 // Accessed atomically. With max_age, the last round in which a node may forward the rumor.
+	forwarders int64 // Accessed atomically. With max_age in async, the number of nodes forwarding the rumor.
+
+	partition  []int         // The group of each node while the network is partitioned, or nil.
+	heal_round int           // The round after which the partition heals, or 0 to never heal.
+	heal_at    time.Duration // When the heal round ended, since the start of the gossip.
+	dropped    int64         // Accessed atomically. The number of messages dropped between groups or lost.
+	loss       float64       // The probability that a message of the goroutine engine is lost.
+
+	events     []scenarioEvent   // The events of the scenario, sorted by round, or nil.
+	next_event int               // The first event of the scenario that has not happened yet.
+	event_log  []scenarioOutcome // What the events that happened did.
+
+	max_rounds int                // The number of rounds after which to stop, or 0.
+	ctx        context.Context    // Cancelled when the gossip must stop.
+	cancel     context.CancelFunc // Cancels ctx.
+	err        error              // Guarded by lock. Why the gossip stopped early, or nil.
 }
 
 func (n *Network) Gossip() {
@@ -49,40 +115,59 @@ func (n *Network) Gossip() {
 		var pullcdur time.Duration = 0
 
 		for {
+			if err := n.ctx.Err(); err != nil {
+				n.fail(err)
+				break
+			}
+
 			num_rounds += 1
+			n.round = num_rounds
+			n.step(num_rounds, "round start")
+			n.apply_events(num_rounds)
+			for i := range n.nodes {
+				n.nodes[i].go_online()
+				n.nodes[i].age_rumor()
+			}
+
+			// Let every node exchange part of its partial view.
+			if n.views != nil {
+				n.step(num_rounds, "shuffle")
+				n.trace(tracePhase, num_rounds, -1, -1, "shuffle")
+				n.run_phase(func(node *Node) {
+					shuffle(n.views, node.node_pos, n.shuffle_len, node.rng)
+				})
+			}
 
 			if n.should_push {
-				dbgPrint(2, "start push")
+				n.step(num_rounds, "push")
+				n.log.trace("start phase", "phase", "push", "round", num_rounds)
+				n.trace(tracePhase, num_rounds, -1, -1, "push")
 
-				// Save the infected value to the current phase infected value.
+				// Save whether each node forwards the rumor for the whole phase.
 				for i := range n.nodes {
 					node := &n.nodes[i]
-					node.phase_infected = node.infected
+					node.phase_infected = node.forwarding()
 					go node.query_set()
 				}
 
 				// Push infection to other nodes.
 				starttime = time.Now()
 
-				n.w_phase.Add(node_num)
-				for i := range n.nodes {
-					node := &n.nodes[i]
-					go node.infect_rand(node_num)
-				}
-				dbgPrint(2, "wait a")
-				n.w_phase.Wait()
+				n.log.trace("wait", "phase", "push")
+				n.run_phase(func(node *Node) {
+					node.infect_rand(node_num)
+				})
 
 				pushdur += time.Since(starttime)
 				starttime = time.Now()
 
 				// Clean up the channels.
-				n.w_phase.Add(node_num)
-				for i := range n.nodes {
-					node := &n.nodes[i]
-					go node.cleanup(node_num, true)
-				}
-				dbgPrint(2, "wait cleanup")
-				n.w_phase.Wait()
+				n.step(num_rounds, "push cleanup")
+				n.trace(tracePhase, num_rounds, -1, -1, "push cleanup")
+				n.log.trace("wait", "phase", "cleanup")
+				n.run_phase(func(node *Node) {
+					node.cleanup(true)
+				})
 
 				pushcdur += time.Since(starttime)
 			}
@@ -90,51 +175,64 @@ func (n *Network) Gossip() {
 			if n.should_pull {
 				// Push the current infected value onto the set channel. This will be
 				// replaced each time it is read.
-				dbgPrint(2, n.nodes)
+				n.step(num_rounds, "pull")
+				n.log.trace("start phase", "phase", "pull", "round", num_rounds, "infected", n.infected_count())
 				for i := range n.nodes {
 					node := &n.nodes[i]
-					n.channels[node.node_pos].set <- node.infected
-					dbgPrint(2, node.node_pos, len(n.channels[node.node_pos].set))
+					n.channels[node.node_pos].set <- message{infected: node.forwarding() && node.is_online(), from: node.node_pos, hops: node.next_hops()}
 				}
 
 				// Pull infection from other nodes.
+				n.trace(tracePhase, num_rounds, -1, -1, "pull")
 				starttime = time.Now()
 
-				n.w_phase.Add(node_num)
-				for i := range n.nodes {
-					node := &n.nodes[i]
-					go node.request_rand(node_num)
-				}
-				n.w_phase.Wait()
+				n.run_phase(func(node *Node) {
+					node.request_rand(node_num)
+				})
 
 				pulldur += time.Since(starttime)
 				starttime = time.Now()
 
 				// Clean up the channels.
-				n.w_phase.Add(node_num)
-				for i := range n.nodes {
-					node := &n.nodes[i]
-					go node.cleanup(node_num, false)
-				}
-				n.w_phase.Wait()
+				n.step(num_rounds, "pull cleanup")
+				n.trace(tracePhase, num_rounds, -1, -1, "pull cleanup")
+				n.run_phase(func(node *Node) {
+					node.cleanup(false)
+				})
 
 				pullcdur += time.Since(starttime)
 			}
 
-			// Exit if the network is fully infected
+			// A round interrupted by a cancellation does not count as completed.
+			if err := n.ctx.Err(); err != nil {
+				n.fail(err)
+				break
+			}
+
+			n.trace(tracePhase, num_rounds, -1, -1, "round end")
+			n.notify_round(num_rounds)
+			n.step(num_rounds, "round end")
+
+			// Exit if the network is fully infected, and the scenario is over.
 			n.lock.RLock()
-			if n.saturated {
+			if n.saturated && !n.events_pending() {
 				n.lock.RUnlock()
 				break
 			}
 			n.lock.RUnlock()
+
+			if n.spreading_stopped(num_rounds) {
+				n.fail(ErrStoppedSpreading)
+				break
+			}
+
+			if n.max_rounds > 0 && num_rounds >= n.max_rounds {
+				n.fail(ErrMaxRounds)
+				break
+			}
 		}
 
-		dbgPrint(1, "push", pushdur)
-		dbgPrint(1, "push clean", pushcdur)
-		dbgPrint(1, "pull", pulldur)
-		dbgPrint(1, "pull clean", pullcdur)
-		n.nodes[0].num_rounds = num_rounds * node_num
+		n.log.debug("phase durations", "push", pushdur, "push clean", pushcdur, "pull", pulldur, "pull clean", pullcdur)
 	} else {
 		node_num := len(n.nodes)
 		n.w.Add(node_num)
@@ -147,13 +245,176 @@ func (n *Network) Gossip() {
 	}
 }
 
+// stop_handlers stops the message handlers of async nodes, and waits until
+// they return, so that no handler sends on a channel after it is closed.
+func (n *Network) stop_handlers() {
+	for i := range n.nodes {
+		close(n.nodes[i].stop_phase)
+	}
+
+	n.handlers.Wait()
+}
+
+// run_phase runs phase on every node in its own goroutine, and waits for all
+// of them to finish. Used only with a leader.
+func (n *Network) run_phase(phase func(node *Node)) {
+	n.w_phase.Add(len(n.nodes))
+	for i := range n.nodes {
+		go func(node *Node) {
+			defer n.w_phase.Done()
+			phase(node)
+		}(&n.nodes[i])
+	}
+	n.w_phase.Wait()
+}
+
+// fail records why the gossip stopped early, and stops all nodes. Only the
+// first failure is kept.
+func (n *Network) fail(err error) {
+	n.lock.Lock()
+	if n.err == nil {
+		n.err = err
+		n.log.warn("gossip stopped", "error", err)
+	}
+	n.lock.Unlock()
+
+	n.cancel()
+}
+
+// notify_round records the messages sent in the round, and calls the
+// observer, if any. It is called at the end of each round by the leader, or
+// by the first node without a leader.
+func (n *Network) notify_round(round int) {
+	sent := n.message_count()
+	n.round_messages = append(n.round_messages, sent-n.last_messages)
+	n.last_messages = sent
+
+	if n.partition != nil && round == n.heal_round {
+		n.heal_at = time.Since(n.start_time)
+	}
+
+	if n.observer != nil {
+		n.observer(n, round)
+	}
+}
+
+// step calls the stepper, if any, between phases of the leader.
+func (n *Network) step(round int, phase string) {
+	if n.stepper != nil {
+		n.stepper(n, round, phase)
+	}
+}
+
+// reachable returns whether a message from one node reaches another in round,
+// which it does unless they are in different groups of a partition that has
+// not healed yet.
+func (n *Network) reachable(from int, to int, round int) bool {
+	return n.partition == nil || (n.heal_round > 0 && round > n.heal_round) || n.partition[from] == n.partition[to]
+}
+
+// delivers returns whether a message from one node reaches another in round:
+// they must be reachable, and then the message is lost with probability loss,
+// drawn from the sender's rng.
+func (n *Network) delivers(from int, to int, round int, rng *rand.Rand) bool {
+	return n.reachable(from, to, round) && (n.loss == 0 || rng.Float64() >= n.loss)
+}
+
+// drop records a message between groups of a partition, or lost, which never
+// arrives.
+func (n *Network) drop(round int, from int, to int, typ string) {
+	atomic.AddInt64(&n.dropped, 1)
+	n.trace(traceDrop, round, from, to, typ)
+}
+
+// infected_count returns the number of currently infected nodes.
+func (n *Network) infected_count() int {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	return n.num_infected
+}
+
+// message_count returns the number of push and pull messages sent so far.
+func (n *Network) message_count() int64 {
+	return atomic.LoadInt64(&n.pushes) + atomic.LoadInt64(&n.pulls)
+}
+
+// is_infected returns whether the node at pos is infected. It may be called
+// concurrently with the gossip.
+func (n *Network) is_infected(pos int) bool {
+	return atomic.LoadUint32(&n.states[pos]) != 0
+}
+
+// hops returns the hops the rumor took to the node at pos, or -1 if it is not
+// infected.
+func (n *Network) hops(pos int) int {
+	return int(atomic.LoadUint32(&n.states[pos])) - 1
+}
+
+// default_max_age returns the rounds a node forwards the rumor for when it
+// cannot tell whether every node knows it: log2 n, enough for push-pull to
+// reach every node of a network of n nodes.
+func default_max_age(node_num int) int {
+	return int(math.Ceil(math.Log2(float64(node_num))))
+}
+
+// forwards returns whether the node at pos forwards the rumor, if it has held
+// it for age rounds.
+func (n *Network) forwards(pos int, age float64) bool {
+	hops := n.hops(pos)
+
+	return hops >= 0 && (n.ttl == 0 || hops < n.ttl) && (n.max_age == 0 || age <= float64(n.max_age))
+}
+
+// start_forwarding records that a node infected in round, with the rumor
+// having taken hops, forwards the rumor for max_age rounds, which pushes the
+// deadline back.
+func (n *Network) start_forwarding(round int, hops int) {
+	if n.max_age == 0 || (n.ttl > 0 && hops >= n.ttl) {
+		return
+	}
+	if n.async {
+		atomic.AddInt64(&n.forwarders, 1)
+	}
+
+	last := int64(round + n.max_age)
+	for {
+		deadline := atomic.LoadInt64(&n.deadline)
+		if deadline >= last || atomic.CompareAndSwapInt64(&n.deadline, deadline, last) {
+			return
+		}
+	}
+}
+
+// stop_forwarding records that an async node that forwarded the rumor with
+// hops aged out.
+func (n *Network) stop_forwarding(hops int) {
+	if n.async && (n.ttl == 0 || hops < n.ttl) {
+		atomic.AddInt64(&n.forwarders, -1)
+	}
+}
+
+// spreading_stopped returns whether no node forwards the rumor after round,
+// because they all aged out. In async, nodes count their own rounds, so it
+// returns whether no node forwards the rumor any more instead.
+func (n *Network) spreading_stopped(round int) bool {
+	if n.max_age == 0 {
+		return false
+	}
+	if n.async {
+		return atomic.LoadInt64(&n.forwarders) == 0
+	}
+
+	return int64(round) >= atomic.LoadInt64(&n.deadline)
+}
+
 // increment_infected increments the number of infected node in the network.
 func (n *Network) increment_infected() {
 	n.lock.Lock()
 
 	n.num_infected += 1
 
-	if n.num_infected == len(n.channels) {
+	if n.num_infected+n.crashed_susceptible >= len(n.channels) {
 		n.saturated = true
 	}
 
@@ -2,16 +2,114 @@ package main
 
 import (
 	"math/rand"
+	"sync/atomic"
 	"time"
 )
 
 type Node struct {
 	node_pos       int
-	infected       bool
-	phase_infected bool
+	phase_infected bool // Whether the node forwarded the rumor at the start of the push phase.
 	stop_phase     chan struct{}
-	num_rounds     int
+	num_rounds     int64
 	network        *Network
+	record         infectionRecord // How the node was infected.
+	log            logger          // The logger for the node's entries.
+	agg            aggregateState  // The aggregation state, used only for aggregates.
+	class          *nodeClass      // The node's class, or nil.
+	offline        uint32          // Accessed atomically. Whether the node is offline in the current round.
+	offline_rounds int             // The number of rounds in which the node was offline.
+	waited         time.Duration   // How long the node waited at the barrier.
+	age            int64           // Accessed atomically. The number of rounds the node started infected.
+	crashed        bool            // Whether the node crashed in a scenario. Changed only between rounds.
+	rng            *rand.Rand      // The node's own random source, used only by the goroutine running its phases.
+}
+
+// current_round returns the round the node is in. Without a leader, nodes
+// count their own rounds, which may be read concurrently in async.
+func (n *Node) current_round() int {
+	if n.network.has_leader {
+		return n.network.round
+	}
+
+	return int(atomic.LoadInt64(&n.num_rounds))
+}
+
+// is_infected returns whether the node is infected. The status is written by
+// the goroutine receiving messages, so it is read atomically.
+func (n *Node) is_infected() bool {
+	return n.network.is_infected(n.node_pos)
+}
+
+// is_online returns whether the node is online in the current round. Offline
+// and crashed nodes neither send nor receive.
+func (n *Node) is_online() bool {
+	return !n.crashed && atomic.LoadUint32(&n.offline) == 0
+}
+
+// go_online decides whether the node is online for a new round, from its
+// class's online probability.
+func (n *Node) go_online() {
+	if n.class == nil || n.class.online >= 1 {
+		return
+	}
+
+	if n.rng.Float64() < n.class.online {
+		atomic.StoreUint32(&n.offline, 0)
+	} else {
+		atomic.StoreUint32(&n.offline, 1)
+		n.offline_rounds += 1
+	}
+}
+
+// fanout returns the number of peers the node contacts in each phase.
+func (n *Node) fanout() int {
+	if n.class == nil {
+		return 1
+	}
+
+	return n.class.fanout
+}
+
+// can_push returns whether the node's class allows it to push.
+func (n *Node) can_push() bool {
+	return n.class == nil || n.class.push
+}
+
+// can_pull returns whether the node's class allows it to pull.
+func (n *Node) can_pull() bool {
+	return n.class == nil || n.class.pull
+}
+
+// process waits for the processing delay of the node's class, if any.
+func (n *Node) process() {
+	if n.class != nil && n.class.delay > 0 {
+		time.Sleep(n.class.delay)
+	}
+}
+
+// age_rumor ages the node's copy of the rumor by a round, at the start of a
+// round.
+func (n *Node) age_rumor() {
+	if !n.is_infected() {
+		return
+	}
+
+	age := atomic.AddInt64(&n.age, 1)
+	if n.network.max_age > 0 && age == int64(n.network.max_age)+1 {
+		n.network.stop_forwarding(n.network.hops(n.node_pos))
+	}
+}
+
+// forwarding returns whether the node forwards the rumor, which it does while
+// the rumor has taken fewer hops than the TTL and is at most max_age rounds
+// old for the node.
+func (n *Node) forwarding() bool {
+	return n.network.forwards(n.node_pos, float64(atomic.LoadInt64(&n.age)))
+}
+
+// next_hops returns the hops the rumor takes to a peer the node sends it to.
+func (n *Node) next_hops() int {
+	return n.network.hops(n.node_pos) + 1
 }
 
 // done calls done on the network's waitgroup.
@@ -19,89 +117,169 @@ func (n *Node) done() {
 	n.network.w.Done()
 }
 
-// infect sets the current node to infected, and tells the network to increment
-// the number of infected nodes.
-func (n *Node) infect(infected bool) {
-	if n.infected || !infected {
+// infect sets the current node to infected if msg carries an infection,
+// records who infected it, and tells the network to increment the number of
+// infected nodes.
+func (n *Node) infect(msg message) {
+	if !msg.infected || !n.is_online() || !atomic.CompareAndSwapUint32(&n.network.states[n.node_pos], 0, uint32(msg.hops)+1) {
 		return
 	}
 
-	dbgPrint(1, n.node_pos, "I")
-	n.infected = true
+	n.log.debug("infected", "from", msg.from, "pull", msg.pull)
+	n.record = infectionRecord{
+		infected: true,
+		from:     msg.from,
+		round:    n.current_round(),
+		pull:     msg.pull,
+		at:       time.Since(n.network.start_time),
+		hops:     msg.hops,
+	}
+	n.network.trace(traceInfect, n.record.round, msg.from, n.node_pos, n.record.mechanism())
+	n.network.start_forwarding(n.record.round, msg.hops)
 
 	n.network.increment_infected()
 }
 
+// select_peer returns the position of the node to gossip with. If the network
+// uses peer sampling, the peer is taken from the node's partial view.
+// Otherwise, it is chosen uniformly among all other nodes.
+func (n *Node) select_peer(node_num int) int {
+	if n.network.views != nil {
+		return n.network.views[n.node_pos].random_peer(n.rng)
+	}
+
+	rand_pos := n.node_pos
+
+	// Generate a random position that is not the same as the current node's.
+	for rand_pos == n.node_pos {
+		rand_pos = n.rng.Intn(node_num)
+	}
+
+	return rand_pos
+}
+
+// infect_rand pushes to fanout random peers if the node forwards the rumor.
+// In a synchronous network, only nodes forwarding it at the start of the phase
+// push.
 func (n *Node) infect_rand(node_num int) {
-	if !n.network.async {
-		defer n.network.w_phase.Done()
+	if !n.can_push() || !n.is_online() {
+		return
 	}
+	n.process()
 
-	if n.infected {
-		rand_pos := n.node_pos
+	infected := n.phase_infected
+	if n.network.async {
+		infected = n.forwarding()
+	}
 
-		// Generate a random position that is not the same as the current node's.
-		for rand_pos == n.node_pos {
-			rand_pos = rand.Intn(node_num)
-		}
+	if infected {
+		for i := n.fanout(); i > 0; i-- {
+			rand_pos := n.select_peer(node_num)
+			if rand_pos < 0 {
+				return
+			}
 
-		if n.network.async {
-			n.infect_other_async(rand_pos)
-		} else {
-			n.infect_other_sync(rand_pos)
+			if n.network.async {
+				n.infect_other_async(rand_pos, false, n.rng)
+			} else {
+				n.infect_other_sync(rand_pos)
+			}
 		}
 	}
 }
 
+// request_rand pulls from fanout random peers if the node is susceptible.
 func (n *Node) request_rand(node_num int) {
-	if !n.network.async {
-		defer n.network.w_phase.Done()
+	if !n.can_pull() || !n.is_online() {
+		return
 	}
+	n.process()
 
-	if !n.infected {
-		rand_pos := n.node_pos
-
-		// Generate a random position that is not the same as the current node's.
-		for rand_pos == n.node_pos {
-			rand_pos = rand.Intn(node_num)
-		}
+	if !n.is_infected() {
+		for i := n.fanout(); i > 0; i-- {
+			rand_pos := n.select_peer(node_num)
+			if rand_pos < 0 {
+				return
+			}
 
-		if n.network.async {
-			n.request_other_async(rand_pos)
-		} else {
-			n.request_other_sync(rand_pos)
+			if n.network.async {
+				n.request_other_async(rand_pos)
+			} else {
+				n.request_other_sync(rand_pos)
+			}
 		}
 	}
 }
 
-// infect_other_sync pushes its phase infection status to other_node.
+// infect_other_sync pushes its phase infection status to other_node. Returns
+// false if the gossip was stopped before the push could be buffered.
 func (n *Node) infect_other_sync(other_node int) bool {
-	dbgPrint(1, n.node_pos, "->", other_node)
-	n.network.channels[other_node].set <- n.phase_infected
-	return true
+	n.log.debug("push", "to", other_node)
+	atomic.AddInt64(&n.network.pushes, 1)
+	n.network.trace(traceSend, n.current_round(), n.node_pos, other_node, tracePush)
+	if !n.network.delivers(n.node_pos, other_node, n.current_round(), n.rng) {
+		n.network.drop(n.current_round(), n.node_pos, other_node, tracePush)
+		return true
+	}
+
+	select {
+	case n.network.channels[other_node].set <- message{infected: n.phase_infected, from: n.node_pos, hops: n.next_hops()}:
+		return true
+	case <-n.network.ctx.Done():
+		return false
+	}
 }
 
 // request_other_sync pulls other_node's infection status and immediately
-// replaces it for other readers.
+// replaces it for other readers. Returns false if the gossip was stopped before
+// other_node published its status.
 func (n *Node) request_other_sync(other_node int) bool {
-	dbgPrint(1, n.node_pos, "<-", other_node)
-	dbgPrint(2, other_node, len(n.network.channels[other_node].set))
-	infected := <-n.network.channels[other_node].set
-	dbgPrint(2, other_node, len(n.network.channels[other_node].set))
-	n.network.channels[other_node].set <- infected
-	dbgPrint(2, other_node, len(n.network.channels[other_node].set))
+	n.log.debug("pull", "from", other_node)
+	atomic.AddInt64(&n.network.pulls, 1)
+	n.network.trace(traceSend, n.current_round(), n.node_pos, other_node, traceRequest)
+	if !n.network.delivers(n.node_pos, other_node, n.current_round(), n.rng) {
+		n.network.drop(n.current_round(), n.node_pos, other_node, traceRequest)
+		return true
+	}
 
-	n.infect(infected)
+	var msg message
+	select {
+	case msg = <-n.network.channels[other_node].set:
+	case <-n.network.ctx.Done():
+		return false
+	}
+	n.network.channels[other_node].set <- msg
+	if msg.infected {
+		atomic.AddInt64(&n.network.replies, 1)
+	}
+	n.log.trace("replaced status", "of", other_node, "buffered", len(n.network.channels[other_node].set))
+
+	msg.pull = true
+	n.network.trace(traceReceive, n.current_round(), other_node, n.node_pos, traceReply)
+	n.infect(msg)
 
 	return true
 }
 
-// infect_other_async attempts to infect other_node. Returns whether the push was
-// successful. The push could fail if other_node's set buffer is full.
-func (n *Node) infect_other_async(other_node int) bool {
-	dbgPrint(1, n.node_pos, "->", other_node)
+// infect_other_async attempts to infect other_node, either as a push or as the
+// answer to a pull request. Returns whether the push was successful. The push
+// could fail if other_node's set buffer is full. Whether a lossy network loses
+// the message is drawn from rng, which belongs to the calling goroutine.
+func (n *Node) infect_other_async(other_node int, pull bool, rng *rand.Rand) bool {
+	n.log.debug("push", "to", other_node, "reply", pull)
+	typ := tracePush
+	if pull {
+		typ = traceReply
+	}
+	round := n.current_round()
+	if !n.network.delivers(n.node_pos, other_node, round, rng) {
+		n.sent_async(round, other_node, typ)
+		n.network.drop(round, n.node_pos, other_node, typ)
+		return true
+	}
 	select {
-	case n.network.channels[other_node].set <- n.infected:
+	case n.network.channels[other_node].set <- message{infected: n.is_infected(), from: n.node_pos, pull: pull, hops: n.next_hops()}:
+		n.sent_async(round, other_node, typ)
 		return true
 	default:
 		return false
@@ -111,57 +289,91 @@ func (n *Node) infect_other_async(other_node int) bool {
 // request_other_sync attempts to request an infection status from other_node.
 // Returns whether the request was successful.
 func (n *Node) request_other_async(other_node int) bool {
-	dbgPrint(1, n.node_pos, "<-", other_node)
+	n.log.debug("pull", "from", other_node)
+	round := n.current_round()
+	if !n.network.delivers(n.node_pos, other_node, round, n.rng) {
+		n.sent_async(round, other_node, traceRequest)
+		n.network.drop(round, n.node_pos, other_node, traceRequest)
+		return true
+	}
 	select {
 	case n.network.channels[other_node].req <- n.node_pos:
+		n.sent_async(round, other_node, traceRequest)
 		return true
 	default:
 		return false
 	}
 }
 
+// sent_async counts and traces a message that left the node in an async
+// network, whether it was buffered or lost on the way. Messages that did not
+// fit in a full buffer were never sent, so they are not counted.
+func (n *Node) sent_async(round int, other_node int, typ string) {
+	switch typ {
+	case tracePush:
+		atomic.AddInt64(&n.network.pushes, 1)
+	case traceRequest:
+		atomic.AddInt64(&n.network.pulls, 1)
+	case traceReply:
+		atomic.AddInt64(&n.network.replies, 1)
+	}
+	n.network.trace(traceSend, round, n.node_pos, other_node, typ)
+}
+
 // query_set repeatedly reads from the set channel, and infects the current node
 // if needed. Used in either sync or async.
 func (n *Node) query_set() {
-	dbgPrint(2, n.node_pos, "start query")
+	n.log.trace("start query")
 	for {
 		select {
 		case <-n.stop_phase:
-			dbgPrint(2, n.node_pos, "stop query")
+			n.log.trace("stop query")
 			return
-		case infected, ok := <-n.network.channels[n.node_pos].set:
+		case msg, ok := <-n.network.channels[n.node_pos].set:
 			if !ok {
 				return
 			}
 
-			dbgPrint(1, n.node_pos, "<S", infected)
-			n.infect(infected)
+			n.log.debug("received", "from", msg.from, "infected", msg.infected, "reply", msg.pull)
+			if msg.pull {
+				n.network.trace(traceReceive, n.current_round(), msg.from, n.node_pos, traceReply)
+			} else {
+				n.network.trace(traceReceive, n.current_round(), msg.from, n.node_pos, tracePush)
+			}
+			n.infect(msg)
 		}
 	}
 }
 
 // query_req repeatedly reads from the req channel, and responds with an
-// infection set if the current node is infected. Used only in async.
-func (n *Node) query_req() {
+// infection set if the current node forwards the rumor, drawing from rng,
+// since it runs concurrently with the node's phases. Used only in async.
+func (n *Node) query_req(rng *rand.Rand) {
 	for {
-		requestor, ok := <-n.network.channels[n.node_pos].req
+		var requestor int
+		var ok bool
+		select {
+		case <-n.stop_phase:
+			return
+		case requestor, ok = <-n.network.channels[n.node_pos].req:
+		}
 
 		if !ok {
 			break
 		}
 
-		dbgPrint(1, n.node_pos, "<R", requestor)
-		if n.infected {
-			n.infect_other_async(requestor)
+		n.log.debug("requested", "by", requestor)
+		n.network.trace(traceReceive, n.current_round(), requestor, n.node_pos, traceRequest)
+		if n.forwarding() && n.is_online() {
+			n.infect_other_async(requestor, true, rng)
 		}
 	}
 }
 
 // cleanup clears stops running phase handlers and clears the buffer of the set
 // channel. Used only in sync.
-func (n *Node) cleanup(node_num int, stop bool) {
-	defer n.network.w_phase.Done()
-	dbgPrint(2, n.node_pos, "stop phase")
+func (n *Node) cleanup(stop bool) {
+	n.log.trace("stop phase")
 
 	if stop {
 		n.stop_phase <- struct{}{}
@@ -176,8 +388,26 @@ func (n *Node) cleanup(node_num int, stop bool) {
 	}
 }
 
+// await waits at the network's barrier until all nodes reach the same point.
+// If the barrier is broken, the failure is recorded in the network.
+func (n *Node) await(phase string) error {
+	n.log.trace("wait", "phase", phase)
+
+	start := time.Now()
+	_, err := n.network.barrier.Await(n.network.ctx, n.node_pos)
+	waited := time.Since(start)
+	n.waited += waited
+	atomic.AddInt64(&n.network.wait_ns, int64(waited))
+	if err != nil {
+		n.network.fail(err)
+	}
+
+	return err
+}
+
 // Gossip runs the gossip algorithm on the given node with the specified options
-// in the network.
+// in the network. Without a leader, the nodes synchronize each phase at the
+// network's barrier.
 func (n *Node) Gossip() {
 	defer n.done()
 
@@ -190,12 +420,27 @@ func (n *Node) Gossip() {
 	var pullcdur time.Duration = 0
 
 	if async {
-		go n.query_set()
-		go n.query_req()
+		n.network.handlers.Add(2)
+		go func() {
+			defer n.network.handlers.Done()
+			n.query_set()
+		}()
+		rng := rand.New(rand.NewSource(n.rng.Int63()))
+		go func() {
+			defer n.network.handlers.Done()
+			n.query_req(rng)
+		}()
 	}
 
 	for {
-		n.num_rounds += 1
+		atomic.AddInt64(&n.num_rounds, 1)
+		n.go_online()
+		n.age_rumor()
+
+		// Exchange part of the partial view with the oldest neighbour.
+		if n.network.views != nil {
+			shuffle(n.network.views, n.node_pos, n.network.shuffle_len, n.rng)
+		}
 
 		if n.network.should_push {
 			// If the push is enabled and the node is infected, try infecting a random
@@ -203,33 +448,35 @@ func (n *Node) Gossip() {
 			if async {
 				n.infect_rand(node_num)
 			} else {
-				dbgPrint(2, n.node_pos, "start push")
+				n.log.trace("start phase", "phase", "push", "round", n.num_rounds)
+				n.trace_phase("push")
 
-				// Save the infected value to the current phase infected value.
-				n.phase_infected = n.infected
-
-				// Add the number of nodes to the waitgroup.
-				n.network.w_phase.Add(node_num)
+				// Save whether the node forwards the rumor for the whole phase.
+				n.phase_infected = n.forwarding()
 
 				// Push infection to other nodes.
 				if n.node_pos == 0 {
 					starttime = time.Now()
 				}
 				go n.query_set()
-				go n.infect_rand(node_num)
+				n.infect_rand(node_num)
 
-				dbgPrint(2, n.node_pos, "wait a")
-				n.network.w_phase.Wait()
+				if n.await("push") != nil {
+					// Stop the handler, so it does not outlive the gossip.
+					n.cleanup(true)
+					return
+				}
 				if n.node_pos == 0 {
 					pushdur += time.Since(starttime)
 					starttime = time.Now()
 				}
 
 				// Clean up the channels.
-				n.network.w_phase.Add(node_num)
-				go n.cleanup(node_num, true)
-				dbgPrint(2, n.node_pos, "wait cleanup")
-				n.network.w_phase.Wait()
+				n.trace_phase("push cleanup")
+				n.cleanup(true)
+				if n.await("push cleanup") != nil {
+					return
+				}
 				if n.node_pos == 0 {
 					pushcdur += time.Since(starttime)
 					starttime = time.Now()
@@ -241,33 +488,33 @@ func (n *Node) Gossip() {
 			if async {
 				n.request_rand(node_num)
 			} else {
-				dbgPrint(2, n.node_pos, "start pull")
+				n.log.trace("start phase", "phase", "pull", "round", n.num_rounds)
+				n.trace_phase("pull")
 
 				// Push the current infected value onto the set channel. This will be
 				// replaced each time it is read.
-				n.network.channels[n.node_pos].set <- n.infected
-
-				// Add the number of nodes to the waitgroup.
-				n.network.w_phase.Add(node_num)
+				n.network.channels[n.node_pos].set <- message{infected: n.forwarding() && n.is_online(), from: n.node_pos, hops: n.next_hops()}
 
 				// Pull infection from other nodes.
 				if n.node_pos == 0 {
 					starttime = time.Now()
 				}
-				go n.request_rand(node_num)
+				n.request_rand(node_num)
 
-				dbgPrint(2, n.node_pos, "wait d")
-				n.network.w_phase.Wait()
+				if n.await("pull") != nil {
+					return
+				}
 				if n.node_pos == 0 {
 					pulldur += time.Since(starttime)
 					starttime = time.Now()
 				}
 
 				// Clean up the channels.
-				n.network.w_phase.Add(node_num)
-				go n.cleanup(node_num, false)
-				dbgPrint(2, n.node_pos, "wait cleanup")
-				n.network.w_phase.Wait()
+				n.trace_phase("pull cleanup")
+				n.cleanup(false)
+				if n.await("pull cleanup") != nil {
+					return
+				}
 				if n.node_pos == 0 {
 					pullcdur += time.Since(starttime)
 					starttime = time.Now()
@@ -277,22 +524,53 @@ func (n *Node) Gossip() {
 
 		if async {
 			time.Sleep(time.Millisecond)
+
+			if err := n.network.ctx.Err(); err != nil {
+				n.network.fail(err)
+				break
+			}
 		}
 
-		// Exit if the network is fully infected
+		if n.node_pos == 0 {
+			n.trace_phase("round end")
+			n.network.notify_round(int(n.num_rounds))
+		}
+
+		// Exit if the network is fully infected, or nobody forwards the rumor
+		// any more.
 		n.network.lock.RLock()
-		if n.network.saturated {
-			dbgPrint(2, n.node_pos, "FULLY SATURATED")
-			n.network.lock.RUnlock()
+		saturated := n.network.saturated
+		n.network.lock.RUnlock()
+		stopped := n.network.spreading_stopped(int(n.num_rounds))
+
+		// All nodes must agree on whether to stop, so nobody starts infecting in
+		// the next round until everyone has checked.
+		if !async && n.await("round end") != nil {
+			return
+		}
+
+		if saturated {
+			n.log.debug("saturated", "round", n.num_rounds)
+			break
+		}
+		if stopped {
+			if async || n.node_pos == 0 {
+				n.network.fail(ErrStoppedSpreading)
+			}
+			break
+		}
+
+		// Without a leader, all nodes reach the maximum in the same round. In
+		// async, the first node to reach it stops the others.
+		if n.network.max_rounds > 0 && int(n.num_rounds) >= n.network.max_rounds {
+			if async || n.node_pos == 0 {
+				n.network.fail(ErrMaxRounds)
+			}
 			break
 		}
-		n.network.lock.RUnlock()
 	}
 
 	if n.node_pos == 0 {
-		dbgPrint(1, "push", pushdur)
-		dbgPrint(1, "push clean", pushcdur)
-		dbgPrint(1, "pull", pulldur)
-		dbgPrint(1, "pull clean", pullcdur)
+		n.log.debug("phase durations", "push", pushdur, "push clean", pushcdur, "pull", pulldur, "pull clean", pullcdur)
 	}
 }
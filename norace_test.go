@@ -0,0 +1,8 @@
+//go:build !race
+// +build !race
+
+package main
+
+// raceEnabled is whether the tests run under the race detector, which slows
+// goroutines down enough to change the round counts of async networks.
+const raceEnabled = false
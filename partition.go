@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parse_partition splits node_num nodes into the groups of spec, separated by
+// semicolons. Each group is either a fraction of the nodes, such as
+// "0.5;0.3", which are taken in order from node 0, or a list of nodes and
+// ranges, such as "0-9,20;10-19". The nodes left out form a last group. It
+// returns the group of each node.
+func parse_partition(spec string, node_num int) ([]int, error) {
+	groups := make([]int, node_num)
+	for i := range groups {
+		groups[i] = -1
+	}
+
+	items := strings.Split(spec, ";")
+	fractions := strings.Contains(items[0], ".")
+	next := 0
+	total := 0.0
+
+	for g, item := range items {
+		item = strings.TrimSpace(item)
+		if strings.Contains(item, ".") != fractions {
+			return nil, fmt.Errorf("mixed fractions and node lists in %q", spec)
+		}
+
+		if fractions {
+			f, err := strconv.ParseFloat(item, 64)
+			if err != nil || !(f > 0 && f <= 1) {
+				return nil, fmt.Errorf("invalid fraction %q, want between 0 and 1", item)
+			}
+			total += f
+			if total > 1+1e-9 {
+				return nil, fmt.Errorf("fractions add up to more than 1 in %q", spec)
+			}
+
+			end := int(total*float64(node_num) + 0.5)
+			for ; next < end && next < node_num; next++ {
+				groups[next] = g
+			}
+			continue
+		}
+
+		nodes, err := parse_node_list(item, node_num)
+		if err != nil {
+			return nil, err
+		}
+		if len(nodes) == 0 {
+			return nil, fmt.Errorf("empty group in %q", spec)
+		}
+		for pos := range nodes {
+			if groups[pos] >= 0 {
+				return nil, fmt.Errorf("node %d is in two groups", pos)
+			}
+			groups[pos] = g
+		}
+	}
+
+	for pos := range groups {
+		if groups[pos] < 0 {
+			groups[pos] = len(items)
+		}
+	}
+
+	return groups, nil
+}
+
+// group_count returns the number of groups of a partition.
+func group_count(groups []int) int {
+	count := 0
+	for _, g := range groups {
+		if g+1 > count {
+			count = g + 1
+		}
+	}
+
+	return count
+}
+
+// partitionSummary is how the rumor spread in a group of a partition.
+type partitionSummary struct {
+	nodes      int
+	first      int // The first node of the group.
+	at_heal    int // The nodes infected by the end of the heal round.
+	infected   int // The nodes infected at the end.
+	last_round int // The round of the last infection in the group.
+}
+
+// summarize_partition returns a summary per group of groups in result, for a
+// partition that healed after heal_round, or never if 0.
+func summarize_partition(groups []int, heal_round int, result GossipResult) []partitionSummary {
+	summaries := make([]partitionSummary, group_count(groups))
+	for i := range summaries {
+		summaries[i].first = -1
+	}
+
+	for pos, g := range groups {
+		s := &summaries[g]
+		s.nodes += 1
+		if s.first < 0 {
+			s.first = pos
+		}
+
+		r := result.infections[pos]
+		if !r.infected {
+			continue
+		}
+		s.infected += 1
+		if heal_round == 0 || r.round <= heal_round {
+			s.at_heal += 1
+		}
+		if r.round > s.last_round {
+			s.last_round = r.round
+		}
+	}
+
+	return summaries
+}
+
+// heal_convergence returns the rounds and time from the end of the heal round
+// until the network was fully infected.
+func heal_convergence(heal_round int, result GossipResult) (int, time.Duration) {
+	rounds := len(result.curve) - 1 - heal_round
+	if rounds < 0 {
+		rounds = 0
+	}
+
+	return rounds, result.duration - result.heal_at
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePartition(t *testing.T) {
+	tests := []struct {
+		spec string
+		want []int
+	}{
+		{"0.5", []int{0, 0, 0, 1, 1, 1}},
+		{"0.5;0.5", []int{0, 0, 0, 1, 1, 1}},
+		{"0.2;0.3", []int{0, 1, 1, 2, 2, 2}},
+		{"0-1;4", []int{0, 0, 2, 2, 1, 2}},
+		{"0,5;1-4", []int{0, 1, 1, 1, 1, 0}},
+	}
+
+	for _, test := range tests {
+		groups, err := parse_partition(test.spec, 6)
+		if err != nil {
+			t.Errorf("%q: %v", test.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(groups, test.want) {
+			t.Errorf("%q: got %v, want %v", test.spec, groups, test.want)
+		}
+	}
+
+	for _, spec := range []string{"", "1.5", "0.7;0.7", "0.5;0-2", "0-2;2", "6", "x", "0-2000000000"} {
+		if _, err := parse_partition(spec, 6); err == nil {
+			t.Errorf("%q: parsed", spec)
+		}
+	}
+}
+
+// TestPartition checks that in the synchronous modes, the rumor
+// does not cross into the other half of the network before the heal, and the
+// network converges after it.
+func TestPartition(t *testing.T) {
+	partition, _ := parse_partition("0.5", testNodes)
+
+	modes := []gossipConfig{{leader: true}, {}, {engine: enginePool}, {median: true}}
+	for _, mode := range modes {
+		config := test_config(mode, true, true)
+		config.partition = partition
+		config.heal_round = 5
+
+		result := run_config(t, mode.network_mode(), config, nil)
+		if result.dropped == 0 {
+			t.Errorf("%s: dropped no messages", mode.network_mode())
+		}
+
+		summaries := summarize_partition(partition, config.heal_round, result)
+		if len(summaries) != 2 || summaries[1].at_heal != 0 || summaries[1].infected != testNodes/2 {
+			t.Errorf("%s: got summaries %+v", mode.network_mode(), summaries)
+		}
+	}
+}
+
+// TestPartitionNeverHeals checks that without a heal, the other half of the
+// network is never infected.
+func TestPartitionNeverHeals(t *testing.T) {
+	partition, _ := parse_partition("0.5", testNodes)
+
+	for _, mode := range testModes[:4] {
+		config := mode.config(true, true)
+		config.partition = partition
+		config.max_rounds = 30
+		if mode.async {
+			config.max_rounds = 200
+		}
+
+		result := run_config(t, mode.name, config, ErrMaxRounds)
+		if result.infected != testNodes/2 {
+			t.Errorf("%s: %d nodes infected, want %d", mode.name, result.infected, testNodes/2)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// viewEntry is a single neighbour descriptor in a node's partial view.
+type viewEntry struct {
+	pos int // The position of the neighbour in the network.
+	age int // The number of shuffles since the descriptor was created.
+}
+
+// PeerView is a bounded partial view of the network, maintained with the
+// Cyclon shuffling protocol. Instead of knowing every other node, each node
+// only knows the entries of its view, and picks its gossip targets from them.
+type PeerView struct {
+	entries []viewEntry // Guarded by lock. The current neighbours.
+	size    int         // The maximum number of entries in the view.
+	lock    sync.Mutex  // The mutex to guard entries.
+}
+
+// new_peer_views creates a view of view_size random distinct neighbours for
+// each of the node_num nodes, drawn from rng.
+func new_peer_views(node_num int, view_size int, rng *rand.Rand) []PeerView {
+	if view_size > node_num-1 {
+		view_size = node_num - 1
+	}
+
+	views := make([]PeerView, node_num)
+	for i := range views {
+		views[i].size = view_size
+		views[i].entries = make([]viewEntry, 0, view_size)
+
+		for _, pos := range rng.Perm(node_num) {
+			if len(views[i].entries) == view_size {
+				break
+			}
+			if pos != i {
+				views[i].entries = append(views[i].entries, viewEntry{pos, 0})
+			}
+		}
+	}
+
+	return views
+}
+
+// random_peer returns the position of a random neighbour in the view, drawn
+// from rng, or -1 if the view is empty.
+func (v *PeerView) random_peer(rng *rand.Rand) int {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if len(v.entries) == 0 {
+		return -1
+	}
+
+	return v.entries[rng.Intn(len(v.entries))].pos
+}
+
+// contains returns whether the view has an entry for pos. The lock must be held.
+func (v *PeerView) contains(pos int) bool {
+	for _, e := range v.entries {
+		if e.pos == pos {
+			return true
+		}
+	}
+
+	return false
+}
+
+// remove_index removes the entry at index i. The lock must be held.
+func (v *PeerView) remove_index(i int) viewEntry {
+	e := v.entries[i]
+	v.entries[i] = v.entries[len(v.entries)-1]
+	v.entries = v.entries[:len(v.entries)-1]
+	return e
+}
+
+// take_random removes up to count random entries from the view, drawn from
+// rng, and returns them. The lock must be held.
+func (v *PeerView) take_random(count int, rng *rand.Rand) []viewEntry {
+	taken := make([]viewEntry, 0, count)
+	for len(taken) < count && len(v.entries) > 0 {
+		taken = append(taken, v.remove_index(rng.Intn(len(v.entries))))
+	}
+
+	return taken
+}
+
+// merge adds the received entries to the view, skipping entries pointing to
+// self_pos or already in the view. Once the view is full, the remaining free
+// slots are filled with the entries that were sent away. The lock must be held.
+func (v *PeerView) merge(self_pos int, received []viewEntry, sent []viewEntry) {
+	for _, e := range received {
+		if len(v.entries) == v.size {
+			break
+		}
+		if e.pos != self_pos && !v.contains(e.pos) {
+			v.entries = append(v.entries, e)
+		}
+	}
+
+	for _, e := range sent {
+		if len(v.entries) == v.size {
+			break
+		}
+		if e.pos != self_pos && !v.contains(e.pos) {
+			v.entries = append(v.entries, e)
+		}
+	}
+}
+
+// shuffle performs one Cyclon exchange initiated by the node at self_pos.
+// The oldest neighbour is removed from the view and exchanges up to
+// shuffle_len descriptors with the initiator, which includes a fresh
+// descriptor of itself so that the neighbour learns about it. The entries
+// exchanged are drawn from the initiator's rng.
+func shuffle(views []PeerView, self_pos int, shuffle_len int, rng *rand.Rand) {
+	self := &views[self_pos]
+
+	self.lock.Lock()
+	if len(self.entries) == 0 {
+		self.lock.Unlock()
+		return
+	}
+
+	oldest := 0
+	for i := range self.entries {
+		self.entries[i].age += 1
+		if self.entries[i].age > self.entries[oldest].age {
+			oldest = i
+		}
+	}
+	other_pos := self.remove_index(oldest).pos
+	self.lock.Unlock()
+
+	other := &views[other_pos]
+
+	// Always lock the views in order of position, to avoid deadlocking with a
+	// concurrent shuffle in the opposite direction.
+	if self_pos < other_pos {
+		self.lock.Lock()
+		other.lock.Lock()
+	} else {
+		other.lock.Lock()
+		self.lock.Lock()
+	}
+
+	sent := self.take_random(shuffle_len-1, rng)
+	sent_to_other := append([]viewEntry{{self_pos, 0}}, sent...)
+	replies := other.take_random(shuffle_len, rng)
+
+	other.merge(other_pos, sent_to_other, replies)
+	self.merge(self_pos, replies, sent)
+
+	other.lock.Unlock()
+	self.lock.Unlock()
+}
+
+// in_degrees returns the number of views that contain each node.
+func in_degrees(views []PeerView) []int {
+	degrees := make([]int, len(views))
+	for i := range views {
+		views[i].lock.Lock()
+		for _, e := range views[i].entries {
+			degrees[e.pos] += 1
+		}
+		views[i].lock.Unlock()
+	}
+
+	return degrees
+}
+
+// degreeStats summarizes an in-degree distribution.
+type degreeStats struct {
+	min       int
+	max       int
+	mean      float64
+	stddev    float64
+	histogram map[int]int // Number of nodes with each in-degree.
+}
+
+// summarize_degrees computes the statistics of the in-degree distribution.
+func summarize_degrees(degrees []int) degreeStats {
+	stats := degreeStats{histogram: make(map[int]int)}
+	if len(degrees) == 0 {
+		return stats
+	}
+
+	stats.min = degrees[0]
+	total := 0
+	for _, d := range degrees {
+		total += d
+		stats.histogram[d] += 1
+		if d < stats.min {
+			stats.min = d
+		}
+		if d > stats.max {
+			stats.max = d
+		}
+	}
+	stats.mean = float64(total) / float64(len(degrees))
+
+	variance := 0.0
+	for _, d := range degrees {
+		variance += (float64(d) - stats.mean) * (float64(d) - stats.mean)
+	}
+	stats.stddev = math.Sqrt(variance / float64(len(degrees)))
+
+	return stats
+}
+
+// sorted_degrees returns the in-degrees present in the histogram in increasing
+// order.
+func (s degreeStats) sorted_degrees() []int {
+	keys := make([]int, 0, len(s.histogram))
+	for d := range s.histogram {
+		keys = append(keys, d)
+	}
+	sort.Ints(keys)
+
+	return keys
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// poissonCheckEvery is how many ticks pass between checks whether the gossip
+// was stopped.
+const poissonCheckEvery = 1024
+
+// poissonModel simulates an asynchronous network in which every node has an
+// independent Poisson clock of the same rate, and gossips at each tick: an
+// infected node pushes, and a susceptible node pulls. The clocks together
+// tick as a single Poisson process with n times the rate, with each tick
+// belonging to a uniformly random node, so the model is simulated as a
+// sequence of ticks in a single goroutine.
+//
+// Time is continuous, in units in which a clock of rate 1 ticks once on
+// average. For rounds, the curve and observers, round k is the time from k-1
+// to k.
+type poissonModel struct {
+	network  *Network
+	node_num int
+	rate     float64 // The rate of each node's clock, in ticks per time unit.
+	rng      *rand.Rand
+	records  []infectionRecord
+	now      float64 // The time of the last tick.
+	ticks    int64   // The number of ticks so far.
+	deadline float64 // With a maximum age, the time after which no node forwards the rumor.
+}
+
+// select_peer returns a uniformly random node other than pos.
+func (m *poissonModel) select_peer(pos int) int {
+	peer := m.rng.Intn(m.node_num - 1)
+	if peer >= pos {
+		peer += 1
+	}
+
+	return peer
+}
+
+// forwards returns whether pos forwards the rumor at the current time. The
+// age of its rumor is measured in time units.
+func (m *poissonModel) forwards(pos int) bool {
+	return m.network.forwards(pos, m.now-m.records[pos].time)
+}
+
+// infect infects pos by from at the current time, if it is not infected yet.
+func (m *poissonModel) infect(pos int, from int, pull bool) {
+	n := m.network
+	if n.is_infected(pos) {
+		return
+	}
+
+	hops := n.hops(from) + 1
+	n.states[pos] = uint32(hops) + 1
+	m.records[pos] = infectionRecord{
+		infected: true,
+		from:     from,
+		round:    n.round,
+		pull:     pull,
+		at:       time.Since(n.start_time),
+		time:     m.now,
+		hops:     hops,
+	}
+	n.trace(traceInfect, n.round, from, pos, m.records[pos].mechanism())
+	n.num_infected += 1
+
+	if n.max_age > 0 && (n.ttl == 0 || hops < n.ttl) {
+		m.deadline = math.Max(m.deadline, m.now+float64(n.max_age))
+	}
+}
+
+// tick lets pos gossip once.
+func (m *poissonModel) tick(pos int) {
+	n := m.network
+
+	if n.is_infected(pos) {
+		if n.should_push && m.forwards(pos) {
+			peer := m.select_peer(pos)
+			n.pushes += 1
+			n.trace(traceSend, n.round, pos, peer, tracePush)
+			if !n.reachable(pos, peer, n.round) {
+				n.drop(n.round, pos, peer, tracePush)
+				return
+			}
+			m.infect(peer, pos, false)
+		}
+	} else if n.should_pull {
+		peer := m.select_peer(pos)
+		n.pulls += 1
+		n.trace(traceSend, n.round, pos, peer, traceRequest)
+		if !n.reachable(pos, peer, n.round) {
+			n.drop(n.round, pos, peer, traceRequest)
+			return
+		}
+		n.trace(traceReceive, n.round, peer, pos, traceReply)
+		if m.forwards(peer) {
+			n.replies += 1
+			m.infect(pos, peer, true)
+		}
+	}
+}
+
+// Gossip runs ticks until the network is fully infected, the gossip is
+// stopped or the maximum time is reached.
+func (m *poissonModel) Gossip() {
+	n := m.network
+	total_rate := m.rate * float64(m.node_num)
+	n.round = 1
+
+	for n.num_infected < m.node_num {
+		if m.ticks%poissonCheckEvery == 0 {
+			if err := n.ctx.Err(); err != nil {
+				n.fail(err)
+				return
+			}
+		}
+
+		m.now += m.rng.ExpFloat64() / total_rate
+
+		// Once every node aged out, nothing changes any more.
+		stopped := n.max_age > 0 && m.now > m.deadline
+		if stopped {
+			m.now = m.deadline
+		}
+
+		// End the rounds that passed before this tick.
+		for m.now > float64(n.round) {
+			n.notify_round(n.round)
+			if n.max_rounds > 0 && n.round >= n.max_rounds {
+				m.now = float64(n.round)
+				n.fail(ErrMaxRounds)
+				return
+			}
+			n.round += 1
+		}
+
+		if stopped {
+			n.notify_round(n.round)
+			n.fail(ErrStoppedSpreading)
+			return
+		}
+
+		m.ticks += 1
+		m.tick(m.rng.Intn(m.node_num))
+	}
+
+	n.notify_round(n.round)
+}
+
+// start_poisson runs the gossip of config with the Poisson clock model. The
+// nodes run in a single goroutine, so the network needs no locks, and the run
+// is reproducible from its seed.
+func start_poisson(ctx context.Context, config gossipConfig, seed int64) GossipResult {
+	node_num := config.node_num
+
+	network := &Network{
+		async:        true,
+		should_push:  config.should_push,
+		should_pull:  config.should_pull,
+		num_infected: config.infected_num,
+		ttl:          config.ttl,
+		max_age:      config.rumor_max_age(),
+		partition:    config.partition,
+		heal_round:   config.heal_round,
+		max_rounds:   config.max_rounds,
+		states:       make([]uint32, node_num),
+		observer:     config.observer,
+		tracer:       config.tracer,
+		log:          new_logger("network"),
+	}
+
+	if config.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.timeout)
+		defer cancel()
+	}
+	network.ctx, network.cancel = context.WithCancel(ctx)
+	defer network.cancel()
+
+	model := &poissonModel{
+		network:  network,
+		node_num: node_num,
+		rate:     config.poisson_rate,
+		rng:      rand.New(rand.NewSource(seed)),
+		records:  make([]infectionRecord, node_num),
+		deadline: float64(config.rumor_max_age()),
+	}
+	network.sim_time = &model.now
+	for i := range model.records {
+		model.records[i] = infectionRecord{from: -1, infected: i < config.infected_num}
+		if i < config.infected_num {
+			network.states[i] = 1
+		}
+	}
+
+	if network.tracer != nil {
+		network.tracer.begin(config)
+	}
+
+	stats := start_stats()
+	network.start_time = time.Now()
+	model.Gossip()
+	duration := time.Since(network.start_time)
+	runtime_stats := stats.finish()
+
+	if network.tracer != nil {
+		network.tracer.record(traceEvent{Kind: traceEnd, Round: len(network.round_messages), Sim: model.now, From: -1, To: -1, Infected: network.num_infected})
+	}
+
+	result := GossipResult{
+		duration:   duration,
+		avg_rounds: float64(model.ticks) / float64(node_num),
+		nodes:      node_num,
+		infections: model.records,
+		curve:      infection_curve(model.records),
+		messages:   network.round_messages,
+		rounds:     len(network.round_messages),
+		infected:   network.num_infected,
+		err:        network.err,
+		stats:      runtime_stats,
+		time:       model.now,
+		pushes:     network.pushes,
+		pulls:      network.pulls,
+		replies:    network.replies,
+		dropped:    network.dropped,
+		heal_at:    network.heal_at,
+	}
+	result.converged = result.err == nil && result.infected >= node_num
+
+	return result
+}
+
+// poisson_expected_time returns the expected time for the algorithm to infect
+// n nodes from a single node with clocks of the given rate: about 2 ln n for
+// push or pull alone, and ln n for push-pull, divided by the rate.
+func poisson_expected_time(algorithm string, n int, rate float64) float64 {
+	t := math.Log(float64(n))
+	if algorithm != "pushpull" {
+		t *= 2
+	}
+
+	return t / rate
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The engines that run a synchronous network.
+const (
+	engineGoroutine = "goroutine" // A goroutine and channels per node.
+	enginePool      = "pool"      // A fixed pool of workers over shards of nodes.
+)
+
+// poolMessage is a push, or the reply to a pull request, to be delivered to
+// node to by the worker owning it.
+type poolMessage struct {
+	to   int32
+	from int32
+	pull bool
+}
+
+// poolWorker is a worker of the pool engine. Each worker owns a contiguous
+// shard of nodes, and is the only one to change their state, so nodes need no
+// locks. Messages to nodes of other shards go through the outboxes.
+type poolWorker struct {
+	index    int
+	lo, hi   int             // The shard of nodes owned by the worker, from lo to hi-1.
+	rng      *rand.Rand      // The worker's own random source, so workers never contend for one.
+	outboxes [][]poolMessage // The messages sent in the current phase, by the index of the receiver's worker.
+	infected int             // The number of infected nodes in the shard.
+	pushes   int64           // The push messages sent in the current phase.
+	pulls    int64           // The pull requests sent in the current phase.
+	replies  int64           // The pull replies carrying the rumor sent in the current phase.
+	tasks    chan func(w *poolWorker)
+}
+
+// workerPool runs the rounds of a synchronous network with one worker per
+// CPU instead of a goroutine per node. Each phase is split into a send step,
+// in which every worker reads the state of any node and fills its outboxes,
+// and a deliver step, in which every worker applies the messages to its own
+// shard. The steps never overlap, so a phase sees the state at its start, like
+// the goroutine engine.
+type workerPool struct {
+	network    *Network
+	records    []infectionRecord // How each node was infected. Written only by the node's worker.
+	workers    []*poolWorker
+	shard_size int
+	done       sync.WaitGroup // Waits for a step to finish on every worker.
+
+	until_stopped bool // Whether to run until no node forwards the rumor, even once every node is infected.
+}
+
+// new_pool creates a pool of GOMAXPROCS workers for the nodes of network, and
+// starts them. Worker i draws its peers from seed + i.
+func new_pool(network *Network, node_num int, infected_num int, seed int64) *workerPool {
+	workers := runtime.GOMAXPROCS(0)
+	if workers > node_num {
+		workers = node_num
+	}
+	shard_size := (node_num + workers - 1) / workers
+	workers = (node_num + shard_size - 1) / shard_size
+
+	p := &workerPool{
+		network:    network,
+		records:    make([]infectionRecord, node_num),
+		workers:    make([]*poolWorker, workers),
+		shard_size: shard_size,
+	}
+
+	for i := range p.records {
+		p.records[i] = infectionRecord{from: -1, infected: i < infected_num}
+		if i < infected_num {
+			network.states[i] = 1
+		}
+	}
+
+	for i := range p.workers {
+		w := &poolWorker{
+			index:    i,
+			lo:       i * shard_size,
+			hi:       (i + 1) * shard_size,
+			rng:      rand.New(rand.NewSource(seed + int64(i))),
+			outboxes: make([][]poolMessage, workers),
+			tasks:    make(chan func(w *poolWorker)),
+		}
+		if w.hi > node_num {
+			w.hi = node_num
+		}
+
+		// Peers are uniform, so each outbox gets about an equal part of the
+		// shard's messages.
+		for j := range w.outboxes {
+			w.outboxes[j] = make([]poolMessage, 0, shard_size/workers+1)
+		}
+		for pos := w.lo; pos < w.hi && pos < infected_num; pos++ {
+			w.infected += 1
+		}
+
+		p.workers[i] = w
+		go func() {
+			for task := range w.tasks {
+				task(w)
+				p.done.Done()
+			}
+		}()
+	}
+
+	return p
+}
+
+// run runs step on every worker, and waits for all of them to finish.
+func (p *workerPool) run(step func(w *poolWorker)) {
+	p.done.Add(len(p.workers))
+	for _, w := range p.workers {
+		w.tasks <- step
+	}
+	p.done.Wait()
+}
+
+// close stops the workers.
+func (p *workerPool) close() {
+	for _, w := range p.workers {
+		close(w.tasks)
+	}
+}
+
+// forwards returns whether the node at pos forwards the rumor in the current
+// round.
+func (p *workerPool) forwards(pos int) bool {
+	n := p.network
+	return n.forwards(pos, float64(n.round-p.records[pos].round))
+}
+
+// select_peer returns a uniformly random node other than pos.
+func (w *poolWorker) select_peer(node_num int, pos int) int {
+	peer := w.rng.Intn(node_num - 1)
+	if peer >= pos {
+		peer += 1
+	}
+
+	return peer
+}
+
+// send queues msg for the worker owning its receiver.
+func (p *workerPool) send(w *poolWorker, msg poolMessage) {
+	owner := int(msg.to) / p.shard_size
+	w.outboxes[owner] = append(w.outboxes[owner], msg)
+}
+
+// reset empties the worker's outboxes, keeping their capacity.
+func (w *poolWorker) reset() {
+	for i := range w.outboxes {
+		w.outboxes[i] = w.outboxes[i][:0]
+	}
+}
+
+// flush adds the worker's message counts of the phase to the network's.
+func (p *workerPool) flush(w *poolWorker) {
+	atomic.AddInt64(&p.network.pushes, w.pushes)
+	atomic.AddInt64(&p.network.pulls, w.pulls)
+	atomic.AddInt64(&p.network.replies, w.replies)
+	w.pushes = 0
+	w.pulls = 0
+	w.replies = 0
+}
+
+// push_step lets every node of the worker's shard that forwards the rumor
+// push to a random peer.
+func (p *workerPool) push_step(w *poolWorker) {
+	n := p.network
+	node_num := len(p.records)
+	w.reset()
+
+	for pos := w.lo; pos < w.hi; pos++ {
+		if !p.forwards(pos) {
+			continue
+		}
+
+		peer := w.select_peer(node_num, pos)
+		w.pushes += 1
+		n.trace(traceSend, n.round, pos, peer, tracePush)
+		if !n.reachable(pos, peer, n.round) {
+			n.drop(n.round, pos, peer, tracePush)
+			continue
+		}
+		p.send(w, poolMessage{to: int32(peer), from: int32(pos)})
+	}
+
+	p.flush(w)
+}
+
+// pull_step lets every susceptible node of the worker's shard request the
+// status of a random peer. Replies carrying an infection are queued for the
+// worker itself.
+func (p *workerPool) pull_step(w *poolWorker) {
+	n := p.network
+	node_num := len(p.records)
+	w.reset()
+
+	for pos := w.lo; pos < w.hi; pos++ {
+		if n.is_infected(pos) {
+			continue
+		}
+
+		peer := w.select_peer(node_num, pos)
+		w.pulls += 1
+		n.trace(traceSend, n.round, pos, peer, traceRequest)
+		if !n.reachable(pos, peer, n.round) {
+			n.drop(n.round, pos, peer, traceRequest)
+			continue
+		}
+		n.trace(traceReceive, n.round, peer, pos, traceReply)
+		if p.forwards(peer) {
+			w.replies += 1
+			p.send(w, poolMessage{to: int32(pos), from: int32(peer), pull: true})
+		}
+	}
+
+	p.flush(w)
+}
+
+// deliver_step applies the messages sent to the worker's shard by every
+// worker.
+func (p *workerPool) deliver_step(w *poolWorker) {
+	n := p.network
+
+	for _, sender := range p.workers {
+		for _, msg := range sender.outboxes[w.index] {
+			to := int(msg.to)
+			if !msg.pull {
+				n.trace(traceReceive, n.round, int(msg.from), to, tracePush)
+			}
+			if n.is_infected(to) {
+				continue
+			}
+
+			hops := n.hops(int(msg.from)) + 1
+			atomic.StoreUint32(&n.states[to], uint32(hops)+1)
+			p.records[to] = infectionRecord{
+				infected: true,
+				from:     int(msg.from),
+				round:    n.round,
+				pull:     msg.pull,
+				at:       time.Since(n.start_time),
+				hops:     hops,
+			}
+			n.trace(traceInfect, n.round, int(msg.from), to, p.records[to].mechanism())
+			n.start_forwarding(n.round, hops)
+			w.infected += 1
+		}
+	}
+}
+
+// count updates the network's number of infected nodes from the shards.
+func (p *workerPool) count() {
+	infected := 0
+	for _, w := range p.workers {
+		infected += w.infected
+	}
+
+	p.network.lock.Lock()
+	p.network.num_infected = infected
+	p.network.saturated = infected >= len(p.records)
+	p.network.lock.Unlock()
+}
+
+// Gossip runs rounds until the network is fully infected, the gossip is
+// stopped or the maximum number of rounds is reached.
+func (p *workerPool) Gossip() {
+	n := p.network
+
+	for {
+		if err := n.ctx.Err(); err != nil {
+			n.fail(err)
+			break
+		}
+
+		n.round += 1
+
+		if n.should_push {
+			n.trace(tracePhase, n.round, -1, -1, "push")
+			p.run(p.push_step)
+			p.run(p.deliver_step)
+		}
+		if n.should_pull {
+			n.trace(tracePhase, n.round, -1, -1, "pull")
+			p.run(p.pull_step)
+			p.run(p.deliver_step)
+		}
+		p.count()
+
+		// A round interrupted by a cancellation does not count as completed.
+		if err := n.ctx.Err(); err != nil {
+			n.fail(err)
+			break
+		}
+
+		n.trace(tracePhase, n.round, -1, -1, "round end")
+		n.notify_round(n.round)
+
+		if n.saturated && !p.until_stopped {
+			break
+		}
+		if n.spreading_stopped(n.round) {
+			if !n.saturated {
+				n.fail(ErrStoppedSpreading)
+			}
+			break
+		}
+		if n.max_rounds > 0 && n.round >= n.max_rounds {
+			n.fail(ErrMaxRounds)
+			break
+		}
+	}
+}
+
+// start_pool runs the gossip of config with the pool engine.
+func start_pool(ctx context.Context, config gossipConfig, seed int64) GossipResult {
+	node_num := config.node_num
+
+	network := &Network{
+		has_leader:  true,
+		should_push: config.should_push,
+		should_pull: config.should_pull,
+		ttl:         config.ttl,
+		max_age:     config.rumor_max_age(),
+		deadline:    int64(config.rumor_max_age()),
+		partition:   config.partition,
+		heal_round:  config.heal_round,
+		max_rounds:  config.max_rounds,
+		states:      make([]uint32, node_num),
+		observer:    config.observer,
+		tracer:      config.tracer,
+		log:         new_logger("network"),
+	}
+
+	if config.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.timeout)
+		defer cancel()
+	}
+	network.ctx, network.cancel = context.WithCancel(ctx)
+	defer network.cancel()
+
+	pool := new_pool(network, node_num, config.infected_num, seed)
+	defer pool.close()
+	pool.until_stopped = config.until_stopped
+	pool.count()
+	network.log.debug("pool", "workers", len(pool.workers), "shard", pool.shard_size)
+
+	if network.tracer != nil {
+		network.tracer.begin(config)
+	}
+
+	stats := start_stats()
+	network.start_time = time.Now()
+	pool.Gossip()
+	duration := time.Since(network.start_time)
+	runtime_stats := stats.finish()
+
+	if network.tracer != nil {
+		network.tracer.record(traceEvent{Kind: traceEnd, Round: len(network.round_messages), Sim: float64(len(network.round_messages)), From: -1, To: -1, Infected: network.infected_count()})
+	}
+
+	result := GossipResult{
+		duration:   duration,
+		avg_rounds: float64(len(network.round_messages)),
+		nodes:      node_num,
+		infections: pool.records,
+		curve:      infection_curve(pool.records),
+		messages:   network.round_messages,
+		rounds:     len(network.round_messages),
+		infected:   network.infected_count(),
+		err:        network.err,
+		stats:      runtime_stats,
+		pushes:     network.pushes,
+		pulls:      network.pulls,
+		replies:    network.replies,
+		dropped:    network.dropped,
+		heal_at:    network.heal_at,
+	}
+	result.converged = result.err == nil && result.infected >= node_num
+
+	return result
+}
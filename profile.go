@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	rtrace "runtime/trace"
+	"sync"
+	"time"
+)
+
+// statsInterval is how often the runtime is sampled for peak values during a
+// run. Reading the memory statistics briefly stops the world, so it is not
+// done more often.
+const statsInterval = 10 * time.Millisecond
+
+// profileOptions are the files to write profiles to. Empty paths are not
+// profiled.
+type profileOptions struct {
+	cpu   string // The CPU profile.
+	mem   string // The heap profile, written at the end.
+	block string // The blocking profile, written at the end.
+	mutex string // The mutex contention profile, written at the end.
+	trace string // The execution trace.
+}
+
+// profiler collects the profiles of profileOptions from start_profiling until
+// stop.
+type profiler struct {
+	opts  profileOptions
+	cpu   *os.File
+	trace *os.File
+}
+
+// start_profiling starts the CPU profile and execution trace, and enables the
+// block and mutex profiles, as requested in opts.
+func start_profiling(opts profileOptions) (*profiler, error) {
+	p := &profiler{opts: opts}
+
+	if opts.cpu != "" {
+		f, err := os.Create(opts.cpu)
+		if err != nil {
+			return nil, err
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+		p.cpu = f
+	}
+
+	if opts.trace != "" {
+		f, err := os.Create(opts.trace)
+		if err != nil {
+			p.stop()
+			return nil, err
+		}
+		if err := rtrace.Start(f); err != nil {
+			f.Close()
+			p.stop()
+			return nil, err
+		}
+		p.trace = f
+	}
+
+	if opts.block != "" {
+		runtime.SetBlockProfileRate(1)
+	}
+	if opts.mutex != "" {
+		runtime.SetMutexProfileFraction(1)
+	}
+
+	return p, nil
+}
+
+// stop stops profiling and writes the profiles. It returns the first error,
+// but still tries to write every profile.
+func (p *profiler) stop() error {
+	var first error
+	keep := func(err error) {
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+
+	if p.cpu != nil {
+		pprof.StopCPUProfile()
+		keep(p.cpu.Close())
+		p.cpu = nil
+	}
+	if p.trace != nil {
+		rtrace.Stop()
+		keep(p.trace.Close())
+		p.trace = nil
+	}
+
+	if p.opts.mem != "" {
+		// Collect garbage first, so the profile shows what is still live.
+		runtime.GC()
+		keep(write_profile("heap", p.opts.mem))
+	}
+	if p.opts.block != "" {
+		keep(write_profile("block", p.opts.block))
+		runtime.SetBlockProfileRate(0)
+	}
+	if p.opts.mutex != "" {
+		keep(write_profile("mutex", p.opts.mutex))
+		runtime.SetMutexProfileFraction(0)
+	}
+	p.opts = profileOptions{}
+
+	return first
+}
+
+// write_profile writes the named runtime profile to path.
+func write_profile(name string, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err := pprof.Lookup(name).WriteTo(f, 0); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// runtimeStats is how much the Go runtime did during a run, to tell the
+// scheduler and garbage collector overhead apart from the gossip itself.
+type runtimeStats struct {
+	peak_goroutines int           // The most goroutines sampled at once.
+	peak_heap       uint64        // The most heap bytes in use sampled at once.
+	num_gc          uint32        // The number of garbage collections.
+	gc_pause        time.Duration // The total time the world was stopped for garbage collection.
+	alloc_bytes     uint64        // The bytes allocated.
+	allocs          uint64        // The number of heap objects allocated.
+}
+
+// statsCollector samples the runtime during a run for peak values, and
+// computes the totals from the memory statistics at the start and end.
+type statsCollector struct {
+	start runtime.MemStats
+	stats runtimeStats
+	stop  chan struct{}
+	done  sync.WaitGroup
+	lock  sync.Mutex // The mutex to guard the peaks in stats.
+}
+
+// start_stats starts collecting runtime statistics.
+func start_stats() *statsCollector {
+	c := &statsCollector{stop: make(chan struct{})}
+	runtime.ReadMemStats(&c.start)
+	c.sample()
+
+	c.done.Add(1)
+	go func() {
+		defer c.done.Done()
+
+		ticker := time.NewTicker(statsInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+				c.sample()
+			}
+		}
+	}()
+
+	return c
+}
+
+// sample updates the peak goroutines and heap in use.
+func (c *statsCollector) sample() {
+	var m runtime.MemStats
+	goroutines := runtime.NumGoroutine()
+	runtime.ReadMemStats(&m)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if goroutines > c.stats.peak_goroutines {
+		c.stats.peak_goroutines = goroutines
+	}
+	if m.HeapInuse > c.stats.peak_heap {
+		c.stats.peak_heap = m.HeapInuse
+	}
+}
+
+// finish stops sampling and returns the statistics of the run.
+func (c *statsCollector) finish() runtimeStats {
+	c.sample()
+	close(c.stop)
+	c.done.Wait()
+
+	var end runtime.MemStats
+	runtime.ReadMemStats(&end)
+
+	stats := c.stats
+	stats.num_gc = end.NumGC - c.start.NumGC
+	stats.gc_pause = time.Duration(end.PauseTotalNs - c.start.PauseTotalNs)
+	stats.alloc_bytes = end.TotalAlloc - c.start.TotalAlloc
+	stats.allocs = end.Mallocs - c.start.Mallocs
+
+	return stats
+}
+
+// String describes the statistics in a single line.
+func (s runtimeStats) String() string {
+	return fmt.Sprintf("peak %d goroutines, %.1f MiB heap in use, %d GCs pausing %v, %.1f MiB allocated in %d objects",
+		s.peak_goroutines, mebibytes(s.peak_heap), s.num_gc, s.gc_pause, mebibytes(s.alloc_bytes), s.allocs)
+}
+
+// mebibytes converts bytes to MiB.
+func mebibytes(b uint64) float64 {
+	return float64(b) / (1 << 20)
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// How far the leader runs before pausing the REPL again.
+const (
+	replPhase = "phase" // Until the next phase boundary.
+	replRound = "round" // Until the end of the round.
+	replEnd   = "end"   // Until the gossip ends.
+)
+
+// replMapWidth is the number of nodes in each line of the infection map.
+const replMapWidth = 64
+
+// replSession steps through a gossip with a leader. The leader pauses in its
+// stepper between phases, while the REPL reads commands, so the REPL can read
+// the nodes without locks while it is paused.
+type replSession struct {
+	out     io.Writer
+	network *Network      // Set by the leader at its first pause.
+	round   int           // The round the leader paused in.
+	phase   string        // The phase the leader paused before.
+	until   string        // How far the leader runs when resumed.
+	stops   chan struct{} // Signalled by the leader when it pauses.
+	resume  chan struct{} // Signalled to let the leader run on.
+}
+
+// step pauses the leader between phases, until the REPL resumes it. It is the
+// session's PhaseObserver.
+func (s *replSession) step(n *Network, round int, phase string) {
+	if s.until == replEnd || (s.until == replRound && phase != "round end") {
+		return
+	}
+
+	s.network, s.round, s.phase = n, round, phase
+	s.stops <- struct{}{}
+	<-s.resume
+}
+
+// replOutcome is how a gossip stepped through by the REPL ended.
+type replOutcome struct {
+	result GossipResult
+	err    error
+}
+
+// runRepl runs config with a leader, pausing before the first round, and
+// reads commands from in to step through it, inspect and change the nodes,
+// until the input ends or it reads quit. It returns an error only if the
+// configuration is invalid.
+func runRepl(ctx context.Context, config gossipConfig, in io.Reader, out io.Writer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	s := &replSession{out: out, until: replPhase, stops: make(chan struct{}), resume: make(chan struct{})}
+	config.stepper = s.step
+
+	done := make(chan replOutcome, 1)
+	go func() {
+		result, err := StartGossip(ctx, config)
+		done <- replOutcome{result, err}
+	}()
+
+	// wait waits until the leader pauses, and returns false once the gossip
+	// ended instead.
+	var outcome *replOutcome
+	wait := func() bool {
+		select {
+		case <-s.stops:
+			fmt.Fprintf(out, "Round %d, before %s: %d of %d nodes infected\n", s.round, s.phase, s.network.infected_count(), len(s.network.nodes))
+			return true
+		case o := <-done:
+			outcome = &o
+			if o.err == nil {
+				s.print_end(o.result)
+			}
+			return false
+		}
+	}
+	// run resumes the leader until it pauses again at until.
+	run := func(until string) {
+		if outcome != nil {
+			fmt.Fprintln(out, "The gossip is over.")
+			return
+		}
+		s.until = until
+		s.resume <- struct{}{}
+		wait()
+	}
+
+	if !wait() && outcome.err != nil {
+		return outcome.err
+	}
+	fmt.Fprintln(out, `Type "help" for the commands.`)
+
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(out, "> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			break
+		}
+
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		arg := strings.Join(fields[1:], "")
+
+		switch fields[0] {
+		case "step", "s":
+			run(replPhase)
+		case "round", "r":
+			run(replRound)
+		case "continue", "c":
+			run(replEnd)
+		case "node", "n":
+			s.print_node(arg, outcome != nil)
+		case "channels", "ch":
+			s.print_channels()
+		case "map", "m":
+			s.print_map()
+		case "status", "st":
+			s.print_status()
+		case eventInject, eventCrash, eventRecover:
+			if outcome != nil {
+				fmt.Fprintln(out, "The gossip is over.")
+				continue
+			}
+			s.schedule(fields[0], arg)
+		case "help", "h", "?":
+			fmt.Fprint(out, replHelp)
+		case "quit", "q", "exit":
+			if outcome == nil {
+				cancel()
+				run(replEnd)
+			}
+			return nil
+		default:
+			fmt.Fprintf(out, "Unknown command %q. Type \"help\" for the commands.\n", fields[0])
+		}
+	}
+
+	if outcome == nil {
+		cancel()
+		run(replEnd)
+	}
+
+	return nil
+}
+
+// replHelp lists the commands of the REPL.
+const replHelp = `step, s             Run to the next phase boundary.
+round, r            Run to the end of the round.
+continue, c         Run to the end of the gossip.
+node, n <node>      Show the state and channel occupancy of a node.
+channels, ch        Show the messages buffered in the channels.
+map, m              Show the infection map: # infected, . susceptible, x crashed.
+status, st          Show the round, infected nodes and messages.
+inject <nodes>      Infect nodes, such as 0,5,10-19, at the start of the next round.
+crash <nodes>       Crash nodes at the start of the next round.
+recover <nodes>     Recover crashed nodes at the start of the next round.
+quit, q             Stop the gossip and exit.
+`
+
+// schedule schedules an event on nodes at the start of the next round, or of
+// this round if it has not started yet.
+func (s *replSession) schedule(action string, list string) {
+	nodes, err := parse_node_list(list, len(s.network.nodes))
+	if err == nil && len(nodes) == 0 {
+		err = fmt.Errorf("no nodes in %q", list)
+	}
+	if err == nil {
+		err = check_events([]scenarioEvent{{action: action, spec: list, nodes: nodes}}, len(s.network.nodes))
+	}
+	if err != nil {
+		fmt.Fprintln(s.out, err)
+		return
+	}
+
+	round := s.round
+	if s.phase != "round start" {
+		round += 1
+	}
+	s.network.schedule(scenarioEvent{round: round, action: action, spec: list, nodes: nodes})
+	fmt.Fprintf(s.out, "%s %s at the start of round %d\n", action, list, round)
+}
+
+// print_node prints the state of the node at the position in arg, and how
+// many messages its channels hold. While pushes may still be delivered, its
+// infection record may change, so it is only printed when over, or before
+// any other phase.
+func (s *replSession) print_node(arg string, over bool) {
+	n := s.network
+	pos, err := strconv.Atoi(arg)
+	if err != nil || pos < 0 || pos >= len(n.nodes) {
+		fmt.Fprintf(s.out, "Need a node between 0 and %d.\n", len(n.nodes)-1)
+		return
+	}
+	node := &n.nodes[pos]
+
+	state := "susceptible"
+	if hops := n.hops(pos); hops >= 0 {
+		state = fmt.Sprintf("infected at %d hops, rumor age %d", hops, atomic.LoadInt64(&node.age))
+		if !node.forwarding() {
+			state += ", no longer forwarding"
+		}
+	}
+	switch {
+	case node.crashed:
+		state += ", crashed"
+	case !node.is_online():
+		state += ", offline"
+	}
+	if node.class != nil {
+		state += ", class " + node.class.name
+	}
+	fmt.Fprintf(s.out, "Node %d: %s\n", pos, state)
+
+	if over || s.phase != "push cleanup" {
+		switch r := node.record; {
+		case !r.infected:
+		case r.from < 0 && r.round == 0:
+			fmt.Fprintln(s.out, "  Infected initially")
+		case r.from < 0:
+			fmt.Fprintf(s.out, "  Injected in round %d\n", r.round)
+		default:
+			fmt.Fprintf(s.out, "  Infected in round %d by node %d (%s)\n", r.round, r.from, r.mechanism())
+		}
+	}
+
+	c := n.channels[pos]
+	fmt.Fprintf(s.out, "  Set channel: %d of %d messages, request channel: %d of %d\n", len(c.set), cap(c.set), len(c.req), cap(c.req))
+}
+
+// print_channels prints how many messages the channels of all nodes hold.
+func (s *replSession) print_channels() {
+	sets, set_nodes, set_max := 0, 0, 0
+	reqs, req_nodes := 0, 0
+	for _, c := range s.network.channels {
+		if l := len(c.set); l > 0 {
+			sets += l
+			set_nodes += 1
+			if l > set_max {
+				set_max = l
+			}
+		}
+		if l := len(c.req); l > 0 {
+			reqs += l
+			req_nodes += 1
+		}
+	}
+
+	fmt.Fprintf(s.out, "Set channels: %d messages in %d nodes, at most %d\n", sets, set_nodes, set_max)
+	fmt.Fprintf(s.out, "Request channels: %d requests in %d nodes\n", reqs, req_nodes)
+}
+
+// print_map prints a character per node, replMapWidth to a line.
+func (s *replSession) print_map() {
+	n := s.network
+	var b strings.Builder
+	for pos := range n.nodes {
+		if pos%replMapWidth == 0 {
+			if pos > 0 {
+				b.WriteByte('\n')
+			}
+			fmt.Fprintf(&b, "%6d ", pos)
+		}
+
+		switch {
+		case n.nodes[pos].crashed:
+			b.WriteByte('x')
+		case n.is_infected(pos):
+			b.WriteByte('#')
+		default:
+			b.WriteByte('.')
+		}
+	}
+	fmt.Fprintln(s.out, b.String())
+}
+
+// print_status prints where the leader paused and how far the gossip got.
+func (s *replSession) print_status() {
+	n := s.network
+	crashed := 0
+	for i := range n.nodes {
+		if n.nodes[i].crashed {
+			crashed += 1
+		}
+	}
+
+	fmt.Fprintf(s.out, "Round %d, before %s: %d of %d nodes infected, %d crashed, %d pushes, %d pulls, %d dropped\n",
+		s.round, s.phase, n.infected_count(), len(n.nodes), crashed,
+		atomic.LoadInt64(&n.pushes), atomic.LoadInt64(&n.pulls), atomic.LoadInt64(&n.dropped))
+}
+
+// print_end prints how the gossip ended.
+func (s *replSession) print_end(result GossipResult) {
+	if result.converged {
+		fmt.Fprintf(s.out, "The gossip converged after %d rounds and %v\n", result.rounds, result.duration)
+		return
+	}
+
+	fmt.Fprintf(s.out, "The gossip stopped after %d rounds with %d of %d nodes infected: %v\n",
+		result.rounds, result.infected, result.nodes, result.err)
+}
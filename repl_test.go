@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRepl steps through a gossip with a script of commands, and checks that
+// the REPL pauses between phases, applies the nodes it crashes and injects,
+// and runs to the end.
+func TestRepl(t *testing.T) {
+	config := gossipConfig{
+		node_num:     testNodes,
+		infected_num: 1,
+		should_push:  true,
+		should_pull:  true,
+		leader:       true,
+		timeout:      time.Minute,
+		seed:         1,
+	}
+
+	script := strings.Join([]string{
+		"node 0", "step", "step", "channels", "status",
+		"crash 200-255", "inject 100", "round", "round", "node 100", "map",
+		"continue", "node 200", "step", "quit",
+	}, "\n")
+	var out bytes.Buffer
+	if err := runRepl(context.Background(), config, strings.NewReader(script), &out); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"Round 1, before round start: 1 of 256 nodes infected",
+		"Node 0: infected at 0 hops",
+		"Round 1, before push:",
+		"Round 1, before push cleanup:",
+		"crash 200-255 at the start of round 2",
+		"Round 2, before round end:",
+		"Node 100: infected at 0 hops",
+		"Injected in round 2",
+		"   192 ",
+		"xxxxxxxx",
+		"The gossip converged after",
+		"Node 200: susceptible, crashed",
+		"The gossip is over.",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output is missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+// TestReplQuit checks that quitting in the middle of the gossip stops it, and
+// that the REPL needs a leader.
+func TestReplQuit(t *testing.T) {
+	config := gossipConfig{node_num: testNodes, infected_num: 1, should_push: true, leader: true, seed: 1}
+
+	var out bytes.Buffer
+	if err := runRepl(context.Background(), config, strings.NewReader("step\nquit\n"), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "The gossip stopped after 0 rounds") {
+		t.Errorf("got output:\n%s", out.String())
+	}
+
+	config.leader = false
+	err := runRepl(context.Background(), config, strings.NewReader(""), &out)
+	if !errors.Is(err, ErrConflictingNetwork) {
+		t.Errorf("got %v, want ErrConflictingNetwork", err)
+	}
+}
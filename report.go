@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math"
+	"os"
+	"strings"
+)
+
+// reportReplayNodes is the largest network to include an animated replay for.
+const reportReplayNodes = 200
+
+// The size of the charts in the report, and the margin for their axes.
+const (
+	chartWidth  = 640
+	chartHeight = 240
+	chartMargin = 40
+)
+
+// reportTemplate is the standalone HTML page of a report. Charts are rendered
+// as inline SVG, and the replay is drawn by inline JavaScript from the
+// infection records, so the page has no external assets.
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>gogossip report</title>
+<style>
+body { font-family: sans-serif; margin: 2em auto; max-width: 700px; color: #222; }
+table { border-collapse: collapse; }
+td { padding: 2px 12px 2px 0; }
+svg text { font-size: 11px; fill: #444; }
+.infected { fill: #d62728; }
+.susceptible { fill: #1f77b4; }
+</style>
+</head>
+<body>
+<h1>gogossip report</h1>
+
+<h2>Configuration</h2>
+<table>
+{{range .Config}}<tr><td>{{index . 0}}</td><td>{{index . 1}}</td></tr>
+{{end}}</table>
+
+<h2>Infection curve</h2>
+{{.Curve}}
+
+<h2>Messages per round</h2>
+{{.Messages}}
+
+<h2>Infection round of each node</h2>
+{{.Histogram}}
+
+{{if .Replay}}
+<h2>Replay</h2>
+<p>
+<button id="play">Play</button>
+<input id="step" type="range" min="0" value="0">
+<span id="label">Round 0</span>
+</p>
+<svg id="replay" width="{{.ReplaySize}}" height="{{.ReplaySize}}"></svg>
+<script>
+(function() {
+	var data = {{.Replay}};
+	var size = {{.ReplaySize}};
+	var ns = "http://www.w3.org/2000/svg";
+	var svg = document.getElementById("replay");
+	var step = document.getElementById("step");
+	var label = document.getElementById("label");
+	var play = document.getElementById("play");
+	var r = size / 2 - 20;
+	var pos = [];
+	var circles = [];
+	var edges = svg.appendChild(document.createElementNS(ns, "g"));
+
+	step.max = data.rounds;
+
+	for (var i = 0; i < data.nodes; i++) {
+		var a = 2 * Math.PI * i / data.nodes;
+		pos.push([size / 2 + r * Math.cos(a), size / 2 + r * Math.sin(a)]);
+		var c = document.createElementNS(ns, "circle");
+		c.setAttribute("cx", pos[i][0]);
+		c.setAttribute("cy", pos[i][1]);
+		c.setAttribute("r", 4);
+		svg.appendChild(c);
+		circles.push(c);
+	}
+
+	function show(round) {
+		label.textContent = "Round " + round;
+		while (edges.firstChild) {
+			edges.removeChild(edges.firstChild);
+		}
+		data.infections.forEach(function(inf, i) {
+			var infected = inf.round >= 0 && inf.round <= round;
+			circles[i].setAttribute("class", infected ? "infected" : "susceptible");
+			if (infected && inf.from >= 0) {
+				var l = document.createElementNS(ns, "line");
+				l.setAttribute("x1", pos[inf.from][0]);
+				l.setAttribute("y1", pos[inf.from][1]);
+				l.setAttribute("x2", pos[i][0]);
+				l.setAttribute("y2", pos[i][1]);
+				l.setAttribute("stroke", inf.round == round ? "#d62728" : "#ccc");
+				if (inf.pull) {
+					l.setAttribute("stroke-dasharray", "4 2");
+				}
+				edges.appendChild(l);
+			}
+		});
+	}
+
+	var timer = null;
+	play.onclick = function() {
+		if (timer) {
+			clearInterval(timer);
+			timer = null;
+			play.textContent = "Play";
+			return;
+		}
+		if (+step.value >= data.rounds) {
+			step.value = 0;
+		}
+		play.textContent = "Pause";
+		timer = setInterval(function() {
+			if (+step.value >= data.rounds) {
+				play.onclick();
+				return;
+			}
+			step.value = +step.value + 1;
+			show(+step.value);
+		}, 700);
+	};
+	step.oninput = function() { show(+step.value); };
+	show(0);
+})();
+</script>
+{{end}}
+</body>
+</html>
+`))
+
+// reportReplay is the data of the animated replay.
+type reportReplay struct {
+	Nodes      int               `json:"nodes"`
+	Rounds     int               `json:"rounds"`
+	Infections []reportInfection `json:"infections"`
+}
+
+// reportInfection is how a node was infected, for the replay.
+type reportInfection struct {
+	From  int  `json:"from"`
+	Round int  `json:"round"`
+	Pull  bool `json:"pull"`
+}
+
+// write_report writes a standalone HTML report of the run to path.
+func write_report(path string, config gossipConfig, result GossipResult) error {
+	curve := make([]float64, len(result.curve))
+	for i, c := range result.curve {
+		curve[i] = float64(c)
+	}
+
+	messages := make([]float64, len(result.messages))
+	for i, m := range result.messages {
+		messages[i] = float64(m)
+	}
+
+	dist := infection_distribution(result)
+	histogram := make([]float64, len(dist.histogram))
+	for i, count := range dist.histogram {
+		histogram[i] = float64(count)
+	}
+
+	data := struct {
+		Config     [][2]string
+		Curve      template.HTML
+		Messages   template.HTML
+		Histogram  template.HTML
+		Replay     template.JS
+		ReplaySize int
+	}{
+		Config: [][2]string{
+			{"Algorithm", config.algorithm()},
+			{"Network", config.network_mode()},
+			{"Nodes", fmt.Sprint(config.node_num)},
+			{"Initially infected", fmt.Sprint(config.infected_num)},
+			{"View size", fmt.Sprint(config.view_size)},
+			{"Duration", fmt.Sprint(result.duration)},
+			{"Average rounds", fmt.Sprint(result.avg_rounds)},
+			{"Completed rounds", fmt.Sprint(result.rounds)},
+			{"Infected", fmt.Sprintf("%d (%.1f%%)", result.infected, 100*result.infected_fraction())},
+			{"Infection round p50/p90/p99", fmt.Sprintf("%g / %g / %g", dist.rounds.p50, dist.rounds.p90, dist.rounds.p99)},
+			{"Rounds until last node", fmt.Sprint(dist.rounds.max)},
+		},
+		Curve:      line_chart(curve, 0, "round", "infected nodes"),
+		Messages:   bar_chart(messages, 1, "round", "messages"),
+		Histogram:  bar_chart(histogram, 0, "infection round", "nodes"),
+		ReplaySize: 400,
+	}
+
+	if dist.has_records {
+		t := dist.elapsed.durations()
+		data.Config = append(data.Config, [2]string{"Infection time p50/p90/p99/max", fmt.Sprintf("%v / %v / %v / %v", t[0], t[1], t[2], t[3])})
+		h := dist.hops
+		data.Config = append(data.Config, [2]string{"Hops p50/p90/p99/max", fmt.Sprintf("%g / %g / %g / %g", h.p50, h.p90, h.p99, h.max)})
+	}
+	if config.ttl > 0 || config.max_age > 0 {
+		data.Config = append(data.Config, [2]string{"TTL / maximum age", fmt.Sprintf("%d / %d", config.ttl, config.rumor_max_age())})
+	}
+	if config.partition != nil {
+		for g, p := range summarize_partition(config.partition, config.heal_round, result) {
+			if p.nodes > 0 {
+				data.Config = append(data.Config, [2]string{fmt.Sprintf("Partition %d infected / by the heal", g), fmt.Sprintf("%d of %d / %d", p.infected, p.nodes, p.at_heal)})
+			}
+		}
+		data.Config = append(data.Config, [2]string{"Heal round / dropped messages", fmt.Sprintf("%d / %d", config.heal_round, result.dropped)})
+	}
+	if dist.has_records && config.poisson_rate > 0 {
+		s := dist.sim_time
+		data.Config = append(data.Config, [2]string{"Simulated infection time p50/p90/p99/max", fmt.Sprintf("%.3f / %.3f / %.3f / %.3f", s.p50, s.p90, s.p99, s.max)})
+	}
+
+	if config.node_num <= reportReplayNodes && result.infections != nil {
+		replay := reportReplay{
+			Nodes:      config.node_num,
+			Rounds:     len(result.curve) - 1,
+			Infections: make([]reportInfection, len(result.infections)),
+		}
+		for i, r := range result.infections {
+			replay.Infections[i] = reportInfection{r.from, r.round, r.pull}
+			if !r.infected {
+				replay.Infections[i].Round = -1
+			}
+		}
+
+		js, err := json.Marshal(replay)
+		if err != nil {
+			return err
+		}
+		data.Replay = template.JS(js)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := reportTemplate.Execute(file, data); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// chart_frame returns the opening of an SVG chart with its axes and labels,
+// and the scale of its values. The caller draws the data and closes the svg.
+func chart_frame(values []float64, first int, xlabel string, ylabel string) (*strings.Builder, float64, float64) {
+	b := &strings.Builder{}
+
+	peak := 0.0
+	for _, v := range values {
+		peak = math.Max(peak, v)
+	}
+	if peak == 0 {
+		peak = 1
+	}
+
+	plot_width := float64(chartWidth - 2*chartMargin)
+	plot_height := float64(chartHeight - 2*chartMargin)
+
+	fmt.Fprintf(b, `<svg width="%d" height="%d" xmlns="http://www.w3.org/2000/svg">`, chartWidth, chartHeight)
+	fmt.Fprintf(b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#444"/>`,
+		chartMargin, chartHeight-chartMargin, chartWidth-chartMargin, chartHeight-chartMargin)
+	fmt.Fprintf(b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#444"/>`,
+		chartMargin, chartMargin, chartMargin, chartHeight-chartMargin)
+	fmt.Fprintf(b, `<text x="%d" y="%d" text-anchor="end">%g</text>`, chartMargin-4, chartMargin+4, peak)
+	fmt.Fprintf(b, `<text x="%d" y="%d" text-anchor="end">0</text>`, chartMargin-4, chartHeight-chartMargin)
+	fmt.Fprintf(b, `<text x="%d" y="%d">%d</text>`, chartMargin, chartHeight-chartMargin+14, first)
+	fmt.Fprintf(b, `<text x="%d" y="%d" text-anchor="end">%d</text>`,
+		chartWidth-chartMargin, chartHeight-chartMargin+14, first+len(values)-1)
+	fmt.Fprintf(b, `<text x="%d" y="%d" text-anchor="middle">%s</text>`,
+		chartWidth/2, chartHeight-8, template.HTMLEscapeString(xlabel))
+	fmt.Fprintf(b, `<text x="%d" y="%d">%s</text>`, chartMargin, chartMargin-12, template.HTMLEscapeString(ylabel))
+
+	return b, plot_width, plot_height / peak
+}
+
+// line_chart draws values as a line, with the x axis starting at first.
+func line_chart(values []float64, first int, xlabel string, ylabel string) template.HTML {
+	b, plot_width, scale := chart_frame(values, first, xlabel, ylabel)
+
+	step := plot_width
+	if len(values) > 1 {
+		step = plot_width / float64(len(values)-1)
+	}
+
+	points := make([]string, len(values))
+	for i, v := range values {
+		points[i] = fmt.Sprintf("%.1f,%.1f", float64(chartMargin)+float64(i)*step, float64(chartHeight-chartMargin)-v*scale)
+	}
+	fmt.Fprintf(b, `<polyline fill="none" stroke="#d62728" stroke-width="2" points="%s"/>`, strings.Join(points, " "))
+	b.WriteString("</svg>")
+
+	return template.HTML(b.String())
+}
+
+// bar_chart draws values as bars, with the x axis starting at first.
+func bar_chart(values []float64, first int, xlabel string, ylabel string) template.HTML {
+	b, plot_width, scale := chart_frame(values, first, xlabel, ylabel)
+
+	width := plot_width
+	if len(values) > 0 {
+		width = plot_width / float64(len(values))
+	}
+
+	for i, v := range values {
+		fmt.Fprintf(b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="#1f77b4"><title>%d: %g</title></rect>`,
+			float64(chartMargin)+float64(i)*width, float64(chartHeight-chartMargin)-v*scale, math.Max(width-1, 1), v*scale, first+i, v)
+	}
+	b.WriteString("</svg>")
+
+	return template.HTML(b.String())
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// The actions of scenario events.
+const (
+	eventCrash     = "crash"     // The nodes stop sending and receiving.
+	eventRecover   = "recover"   // Crashed nodes come back.
+	eventInject    = "inject"    // The nodes learn the rumor, as new sources.
+	eventPartition = "partition" // The network splits into groups.
+	eventHeal      = "heal"      // The partition heals.
+	eventSet       = "set"       // An option of the network changes.
+)
+
+// scenarioEvent is something that happens to the network at the start of a
+// round of a scenario.
+type scenarioEvent struct {
+	round  int
+	action string
+	spec   string       // The nodes or groups as written in the scenario.
+	nodes  map[int]bool // The nodes of crash, recover and inject.
+	option string       // The option changed by set: loss or ttl.
+	value  float64      // The new value of option.
+}
+
+// String describes the event as in "crash 0-99".
+func (e scenarioEvent) String() string {
+	switch e.action {
+	case eventSet:
+		return fmt.Sprintf("set %s %g", e.option, e.value)
+	case eventHeal:
+		return eventHeal
+	}
+
+	return e.action + " " + e.spec
+}
+
+// scenario is a timeline of events, and the run it applies to.
+type scenario struct {
+	algorithm  string // push, pull or pushpull.
+	nodes      int    // The number of nodes, or 0 for -n.
+	infected   int    // The number of initially infected nodes, or 0 for -i.
+	max_rounds int    // The number of rounds after which to give up, or 0 for --max-rounds.
+	seed       int64  // The seed, or 0 for --seed.
+	events     []scenarioEvent
+}
+
+// scenarioFile is the JSON format of a scenario file.
+type scenarioFile struct {
+	Algorithm string `json:"algorithm"`
+	Nodes     int    `json:"nodes"`
+	Infected  int    `json:"infected"`
+	MaxRounds int    `json:"max_rounds"`
+	Seed      int64  `json:"seed"`
+	Events    []struct {
+		Round  int     `json:"round"`
+		Action string  `json:"action"`
+		Nodes  string  `json:"nodes"`
+		Groups string  `json:"groups"`
+		Option string  `json:"option"`
+		Value  float64 `json:"value"`
+	} `json:"events"`
+}
+
+// read_scenario reads a scenario from a JSON file, such as
+// {"algorithm": "pushpull", "events": [{"round": 5, "action": "crash", "nodes": "0-99"}]}.
+// The events are sorted by round, keeping the order of events in the same
+// round. Their nodes must be in a network of node_num nodes, unless the
+// scenario sets its own number of nodes.
+func read_scenario(path string, node_num int) (scenario, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return scenario{}, err
+	}
+
+	var file scenarioFile
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return scenario{}, fmt.Errorf("%s: %w", path, err)
+	}
+
+	s := scenario{
+		algorithm:  file.Algorithm,
+		nodes:      file.Nodes,
+		infected:   file.Infected,
+		max_rounds: file.MaxRounds,
+		seed:       file.Seed,
+	}
+	if s.algorithm == "" {
+		s.algorithm = "pushpull"
+	}
+	if s.nodes > 0 {
+		node_num = s.nodes
+	}
+	if s.algorithm != "push" && s.algorithm != "pull" && s.algorithm != "pushpull" {
+		return scenario{}, fmt.Errorf("%s: unknown algorithm %q, want push, pull or pushpull", path, s.algorithm)
+	}
+
+	for i, f := range file.Events {
+		e := scenarioEvent{round: f.Round, action: f.Action, spec: f.Nodes, option: f.Option, value: f.Value}
+		invalid := func(reason string) error {
+			return fmt.Errorf("%s: event %d (%s in round %d): %s", path, i+1, f.Action, f.Round, reason)
+		}
+
+		if e.round < 1 {
+			return scenario{}, invalid("need a round of at least 1")
+		}
+		switch e.action {
+		case eventCrash, eventRecover, eventInject:
+			e.nodes, err = parse_node_list(f.Nodes, node_num)
+			if err != nil {
+				return scenario{}, invalid(err.Error())
+			}
+			if len(e.nodes) == 0 {
+				return scenario{}, invalid("need nodes")
+			}
+		case eventPartition:
+			if f.Groups == "" {
+				return scenario{}, invalid("need groups")
+			}
+			e.spec = f.Groups
+		case eventHeal:
+		case eventSet:
+			switch {
+			case e.option != "loss" && e.option != "ttl":
+				return scenario{}, invalid(fmt.Sprintf("unknown option %q, want loss or ttl", e.option))
+			case e.option == "loss" && !(e.value >= 0 && e.value <= 1):
+				return scenario{}, invalid("need a loss between 0 and 1")
+			case e.option == "ttl" && (e.value < 0 || e.value != math.Trunc(e.value)):
+				return scenario{}, invalid("need a TTL of 0 for no limit, or more")
+			}
+		default:
+			return scenario{}, invalid("unknown action, want crash, recover, inject, partition, heal or set")
+		}
+
+		s.events = append(s.events, e)
+	}
+
+	sort.SliceStable(s.events, func(i, j int) bool { return s.events[i].round < s.events[j].round })
+
+	return s, nil
+}
+
+// check_events returns a *ConfigError for the first event that does not fit a
+// network of node_num nodes, or nil.
+func check_events(events []scenarioEvent, node_num int) error {
+	for _, e := range events {
+		for pos := range e.nodes {
+			if pos < 0 || pos >= node_num {
+				return &ConfigError{"run", e.String(), fmt.Sprintf("node %d is not between 0 and %d", pos, node_num-1), ErrInvalidOption}
+			}
+		}
+		if e.action == eventPartition {
+			if _, err := parse_partition(e.spec, node_num); err != nil {
+				return &ConfigError{"run", e.String(), err.Error(), ErrInvalidOption}
+			}
+		}
+	}
+
+	return nil
+}
+
+// apply_events applies the events of the scenario that happen at the start of
+// round, between rounds, and records what they did.
+func (n *Network) apply_events(round int) {
+	for n.next_event < len(n.events) && n.events[n.next_event].round <= round {
+		e := n.events[n.next_event]
+		n.next_event += 1
+
+		count := 0
+		switch e.action {
+		case eventCrash:
+			for pos := range e.nodes {
+				if n.crash(pos, true) {
+					count += 1
+				}
+			}
+		case eventRecover:
+			for pos := range e.nodes {
+				if n.crash(pos, false) {
+					count += 1
+				}
+			}
+		case eventInject:
+			for pos := range e.nodes {
+				if n.inject(pos, round) {
+					count += 1
+				}
+			}
+		case eventPartition:
+			n.partition, _ = parse_partition(e.spec, len(n.nodes))
+			n.heal_round = 0
+			count = group_count(n.partition)
+		case eventHeal:
+			if n.partition != nil {
+				n.partition = nil
+				n.heal_round = round - 1
+				n.heal_at = time.Since(n.start_time)
+			}
+		case eventSet:
+			switch e.option {
+			case "loss":
+				n.loss = e.value
+			case "ttl":
+				n.ttl = int(e.value)
+			}
+		}
+
+		n.log.info("scenario event", "round", round, "event", e.String(), "count", count)
+		n.trace(tracePhase, round, -1, -1, "scenario "+e.String())
+		n.event_log = append(n.event_log, scenarioOutcome{event: e, round: round, count: count, infected: n.infected_count()})
+	}
+
+	n.lock.Lock()
+	n.saturated = n.num_infected+n.crashed_susceptible >= len(n.nodes)
+	n.lock.Unlock()
+}
+
+// events_pending returns whether events of the scenario are still to come.
+func (n *Network) events_pending() bool {
+	return n.next_event < len(n.events)
+}
+
+// schedule adds an event to the timeline, after the events of the same round.
+// An event of a round that already started happens at the start of the next.
+// Used only between phases.
+func (n *Network) schedule(e scenarioEvent) {
+	i := n.next_event
+	for i < len(n.events) && n.events[i].round <= e.round {
+		i++
+	}
+
+	events := make([]scenarioEvent, 0, len(n.events)+1)
+	events = append(events, n.events[:i]...)
+	events = append(events, e)
+	n.events = append(events, n.events[i:]...)
+}
+
+// crash crashes or recovers the node at pos, and returns whether it changed.
+// The network converges without the crashed nodes that do not know the
+// rumor.
+func (n *Network) crash(pos int, crashed bool) bool {
+	node := &n.nodes[pos]
+	if node.crashed == crashed {
+		return false
+	}
+	node.crashed = crashed
+
+	if !node.is_infected() {
+		n.lock.Lock()
+		if crashed {
+			n.crashed_susceptible += 1
+		} else {
+			n.crashed_susceptible -= 1
+		}
+		n.lock.Unlock()
+	}
+
+	return true
+}
+
+// inject infects the node at pos in round as a new source of the rumor, and
+// returns whether it was susceptible and running.
+func (n *Network) inject(pos int, round int) bool {
+	node := &n.nodes[pos]
+	if node.crashed || !atomic.CompareAndSwapUint32(&n.states[pos], 0, 1) {
+		return false
+	}
+
+	node.record = infectionRecord{
+		infected: true,
+		from:     -1,
+		round:    round,
+		at:       time.Since(n.start_time),
+	}
+	atomic.StoreInt64(&node.age, 0)
+	n.trace(traceInfect, round, -1, pos, eventInject)
+	n.start_forwarding(round, 0)
+	n.increment_infected()
+
+	return true
+}
+
+// scenarioOutcome is what an event of a scenario did.
+type scenarioOutcome struct {
+	event    scenarioEvent
+	round    int // The round at the start of which the event happened.
+	count    int // The nodes crashed, recovered or injected, or the groups of a partition.
+	infected int // The infected nodes after the event.
+}
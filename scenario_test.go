@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadScenario(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scenario")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "scenario.json")
+	write := func(data string) {
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{"algorithm": "push", "nodes": 50, "events": [
+		{"round": 10, "action": "heal"},
+		{"round": 5, "action": "crash", "nodes": "0-9"},
+		{"round": 5, "action": "set", "option": "loss", "value": 0.2}]}`)
+	s, err := read_scenario(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.algorithm != "push" || s.nodes != 50 || len(s.events) != 3 {
+		t.Fatalf("got %+v", s)
+	}
+	want := []string{"crash 0-9", "set loss 0.2", "heal"}
+	for i, e := range s.events {
+		if e.String() != want[i] {
+			t.Errorf("event %d: got %q, want %q", i, e, want[i])
+		}
+	}
+
+	for _, data := range []string{
+		`{"algorithm": "median"}`,
+		`{"events": [{"round": 0, "action": "heal"}]}`,
+		`{"events": [{"round": 1, "action": "explode"}]}`,
+		`{"events": [{"round": 1, "action": "crash"}]}`,
+		`{"events": [{"round": 1, "action": "partition"}]}`,
+		`{"events": [{"round": 1, "action": "set", "option": "loss", "value": 2}]}`,
+		`{"events": [{"round": 1, "action": "set", "option": "fanout", "value": 2}]}`,
+		`{"events": [], "color": "red"}`,
+		`{"events": [{"round": 1, "action": "crash", "nodes": "0-2000000000"}]}`,
+		`{"nodes": 50, "events": [{"round": 1, "action": "crash", "nodes": "50"}]}`,
+	} {
+		write(data)
+		if _, err := read_scenario(path, 10); err == nil {
+			t.Errorf("%s: read", data)
+		}
+	}
+}
+
+func TestCheckEvents(t *testing.T) {
+	config := gossipConfig{node_num: 10, infected_num: 1, should_push: true, leader: true}
+	config.events = []scenarioEvent{{round: 1, action: eventCrash, spec: "5-10", nodes: map[int]bool{10: true}}}
+	if err := config.validate(); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("node out of range: got %v, want ErrInvalidOption", err)
+	}
+
+	config.events = []scenarioEvent{{round: 1, action: eventPartition, spec: "0.7;0.7"}}
+	if err := config.validate(); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("invalid partition: got %v, want ErrInvalidOption", err)
+	}
+
+	config.events = []scenarioEvent{{round: 1, action: eventHeal}}
+	config.leader = false
+	if err := config.validate(); !errors.Is(err, ErrConflictingNetwork) {
+		t.Errorf("without a leader: got %v, want ErrConflictingNetwork", err)
+	}
+}
+
+// TestScenario checks that crashed nodes are never infected, that the network
+// converges without them, that injected nodes become new sources, and that
+// the gossip runs until the last event.
+func TestScenario(t *testing.T) {
+	crashed := map[int]bool{}
+	for pos := 200; pos < testNodes; pos++ {
+		crashed[pos] = true
+	}
+
+	config := testModes[0].config(true, true)
+	config.events = []scenarioEvent{
+		{round: 1, action: eventCrash, spec: "200-255", nodes: crashed},
+		{round: 1, action: eventPartition, spec: "0.5"},
+		{round: 2, action: eventInject, spec: "150", nodes: map[int]bool{150: true}},
+		{round: 30, action: eventHeal},
+	}
+	config.max_rounds = 100
+
+	result := run_config(t, "scenario", config, nil)
+	if result.crashed != testNodes-200 || result.infected != 200 {
+		t.Errorf("%d infected and %d crashed, want 200 and %d", result.infected, result.crashed, testNodes-200)
+	}
+	if result.rounds < 30 || len(result.events) != 4 {
+		t.Errorf("ran %d rounds and %d events, want at least 30 and 4", result.rounds, len(result.events))
+	}
+	if result.dropped == 0 {
+		t.Error("dropped no messages across the partition")
+	}
+
+	if r := result.infections[150]; !r.infected || r.from != -1 || r.round != 2 {
+		t.Errorf("node 150 got %+v, want injected in round 2", r)
+	}
+	for pos := 200; pos < testNodes; pos++ {
+		if result.infections[pos].infected {
+			t.Errorf("crashed node %d is infected", pos)
+		}
+	}
+}
+
+// TestScenarioLoss checks that with every message lost, the rumor does not
+// spread until the loss is lifted.
+func TestScenarioLoss(t *testing.T) {
+	config := testModes[0].config(true, false)
+	config.events = []scenarioEvent{
+		{round: 1, action: eventSet, option: "loss", value: 1},
+		{round: 10, action: eventSet, option: "loss", value: 0},
+	}
+
+	result := run_config(t, "scenario", config, nil)
+	if result.curve[9] != 1 || result.dropped != 9 {
+		t.Errorf("curve %v and %d dropped, want 1 infected until round 9 and 9 dropped", result.curve, result.dropped)
+	}
+}
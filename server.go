@@ -0,0 +1,604 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The statuses of a job.
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobCancelled = "cancelled"
+)
+
+// jobRequest is the JSON configuration of a submitted job. Its fields follow
+// the command-line options, and those left out get the same defaults.
+type jobRequest struct {
+	Algorithm string  `json:"algorithm"` // push, pull, pushpull or median.
+	Nodes     int     `json:"nodes"`
+	Infected  int     `json:"infected"`
+	Leader    bool    `json:"leader"`
+	Async     bool    `json:"async"`
+	Engine    string  `json:"engine"`
+	Poisson   float64 `json:"poisson"`
+	View      int     `json:"view"`
+	Shuffle   int     `json:"shuffle"`
+	Classes   string  `json:"classes"`
+	TTL       int     `json:"ttl"`
+	MaxAge    int     `json:"max_age"`
+	Partition string  `json:"partition"`
+	Heal      int     `json:"heal"`
+	MaxRounds int     `json:"max_rounds"`
+	Timeout   string  `json:"timeout"`
+	Seed      int64   `json:"seed"`
+}
+
+// config returns the configuration of the request, or a *ConfigError.
+func (r jobRequest) config() (gossipConfig, error) {
+	c := gossipConfig{
+		node_num:     r.Nodes,
+		infected_num: r.Infected,
+		leader:       r.Leader,
+		async:        r.Async,
+		engine:       r.Engine,
+		poisson_rate: r.Poisson,
+		view_size:    r.View,
+		shuffle_len:  r.Shuffle,
+		ttl:          r.TTL,
+		max_age:      r.MaxAge,
+		heal_round:   r.Heal,
+		max_rounds:   r.MaxRounds,
+		seed:         r.Seed,
+	}
+	if c.node_num == 0 {
+		c.node_num = 100
+	}
+	if c.infected_num == 0 {
+		c.infected_num = 1
+	}
+
+	switch r.Algorithm {
+	case "push":
+		c.should_push = true
+	case "pull":
+		c.should_pull = true
+	case "pushpull":
+		c.should_push, c.should_pull = true, true
+	case "median":
+		c.should_push, c.should_pull, c.median = true, true, true
+	default:
+		return c, &ConfigError{"algorithm", r.Algorithm, "use push, pull, pushpull or median", ErrNoAlgorithm}
+	}
+
+	var err error
+	if r.Timeout != "" {
+		if c.timeout, err = time.ParseDuration(r.Timeout); err != nil {
+			return c, &ConfigError{"--timeout", r.Timeout, err.Error(), ErrInvalidOption}
+		}
+	}
+	if r.Classes != "" {
+		if c.classes, err = parse_classes(r.Classes); err != nil {
+			return c, &ConfigError{"--classes", r.Classes, err.Error(), ErrInvalidOption}
+		}
+	}
+	if r.Partition != "" {
+		if c.partition, err = parse_partition(r.Partition, c.node_num); err != nil {
+			return c, &ConfigError{"--partition", r.Partition, err.Error(), ErrInvalidOption}
+		}
+	}
+
+	return c, c.validate()
+}
+
+// jobProgressLimit is the most rounds of progress a job keeps. The streams of
+// longer jobs skip the oldest rounds they have not sent yet.
+const jobProgressLimit = 1000
+
+// jobProgress is the state of a running job at the end of a round.
+type jobProgress struct {
+	Round    int   `json:"round"`
+	Infected int   `json:"infected"`
+	Messages int64 `json:"messages"` // The messages sent so far.
+}
+
+// jobResult is the JSON result of a finished job.
+type jobResult struct {
+	Converged bool    `json:"converged"`
+	Error     string  `json:"error,omitempty"` // Why the gossip stopped before converging.
+	Nodes     int     `json:"nodes"`
+	Infected  int     `json:"infected"`
+	Rounds    int     `json:"rounds"`
+	AvgRounds float64 `json:"avg_rounds"`
+	Duration  float64 `json:"duration_ms"`
+	Messages  int64   `json:"messages"`
+	Dropped   int64   `json:"dropped"`
+	Curve     []int   `json:"curve"` // The infected nodes after each round, from round 0.
+}
+
+// new_job_result returns the JSON result of result.
+func new_job_result(result GossipResult) *jobResult {
+	r := &jobResult{
+		Converged: result.converged,
+		Nodes:     result.nodes,
+		Infected:  result.infected,
+		Rounds:    result.rounds,
+		AvgRounds: result.avg_rounds,
+		Duration:  float64(result.duration) / float64(time.Millisecond),
+		Messages:  result.total_messages(),
+		Dropped:   result.dropped,
+		Curve:     result.curve,
+	}
+	if result.err != nil {
+		r.Error = result.err.Error()
+	}
+
+	return r
+}
+
+// job is a simulation submitted to the server.
+type job struct {
+	id     int
+	config gossipConfig
+
+	lock      sync.Mutex         // Guards the fields below.
+	status    string             // queued, running, done or cancelled.
+	submitted time.Time          // When the job was submitted.
+	started   time.Time          // When the job started running, or zero.
+	finished  time.Time          // When the job finished or was cancelled, or zero.
+	progress  []jobProgress      // The state at the end of the last rounds, at most jobProgressLimit.
+	skipped   int                // The rounds of progress dropped before the first one kept.
+	changed   chan struct{}      // Closed and replaced whenever the job changes.
+	result    *jobResult         // The result of a finished job, or nil.
+	cancel    context.CancelFunc // Cancels a running job.
+}
+
+// jobView is the JSON status of a job.
+type jobView struct {
+	ID        int        `json:"id"`
+	Status    string     `json:"status"`
+	Algorithm string     `json:"algorithm"`
+	Network   string     `json:"network"`
+	Nodes     int        `json:"nodes"`
+	Submitted time.Time  `json:"submitted"`
+	Started   *time.Time `json:"started,omitempty"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	Round     int        `json:"round"`    // The last round completed.
+	Infected  int        `json:"infected"` // The infected nodes at the end of that round.
+	Result    *jobResult `json:"result,omitempty"`
+}
+
+// view returns the status of the job. The lock must be held.
+func (j *job) view() jobView {
+	v := jobView{
+		ID:        j.id,
+		Status:    j.status,
+		Algorithm: j.config.algorithm(),
+		Network:   j.config.network_mode(),
+		Nodes:     j.config.node_num,
+		Submitted: j.submitted,
+		Infected:  j.config.infected_num,
+		Result:    j.result,
+	}
+	if !j.started.IsZero() {
+		started := j.started
+		v.Started = &started
+	}
+	if !j.finished.IsZero() {
+		finished := j.finished
+		v.Finished = &finished
+	}
+	if len(j.progress) > 0 {
+		last := j.progress[len(j.progress)-1]
+		v.Round, v.Infected = last.Round, last.Infected
+	}
+	if j.result != nil {
+		v.Round, v.Infected = j.result.Rounds, j.result.Infected
+	}
+
+	return v
+}
+
+// notify wakes up the streams waiting for the job to change. The lock must be
+// held.
+func (j *job) notify() {
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// over returns whether the job finished or was cancelled. The lock must be
+// held.
+func (j *job) over() bool {
+	return j.status == jobDone || j.status == jobCancelled
+}
+
+// observe records the progress of the job at the end of a round. It is the
+// job's RoundObserver.
+func (j *job) observe(n *Network, round int) {
+	p := jobProgress{Round: round, Infected: n.infected_count(), Messages: n.message_count()}
+
+	j.lock.Lock()
+	if len(j.progress) == jobProgressLimit {
+		j.progress = j.progress[1:]
+		j.skipped += 1
+	}
+	j.progress = append(j.progress, p)
+	j.notify()
+	j.lock.Unlock()
+}
+
+// serverLimits bound what a server keeps and accepts, so that it does not grow
+// however long it runs.
+type serverLimits struct {
+	queue     int // The number of jobs that may wait for a worker.
+	retain    int // The number of finished jobs kept, the oldest forgotten first.
+	max_nodes int // The most nodes a job may have.
+}
+
+// jobServer runs submitted jobs on a fixed number of workers, from a bounded
+// queue.
+type jobServer struct {
+	ctx    context.Context // Cancels every running job when done.
+	queue  chan *job       // The jobs waiting for a worker.
+	limits serverLimits
+	log    logger
+
+	lock     sync.Mutex   // Guards jobs, finished and next_id.
+	jobs     map[int]*job // The jobs queued, running or among the last finished, by id.
+	finished []int        // The ids of the finished jobs kept, in the order they finished.
+	next_id  int
+}
+
+// new_job_server returns a server within limits. Its jobs are cancelled when
+// ctx is done.
+func new_job_server(ctx context.Context, limits serverLimits) *jobServer {
+	return &jobServer{
+		ctx:     ctx,
+		queue:   make(chan *job, limits.queue),
+		limits:  limits,
+		log:     new_logger("server"),
+		jobs:    map[int]*job{},
+		next_id: 1,
+	}
+}
+
+// retire records that a job finished, and forgets the oldest finished jobs
+// beyond the number to retain. The job's lock is held, so that its streams see
+// it over only once it is retired.
+func (s *jobServer) retire(j *job) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.finished = append(s.finished, j.id)
+	for len(s.finished) > s.limits.retain {
+		delete(s.jobs, s.finished[0])
+		s.finished = s.finished[1:]
+	}
+}
+
+// start starts workers that run the queued jobs, until ctx is done.
+func (s *jobServer) start(workers int) {
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case j := <-s.queue:
+					s.run(j)
+				case <-s.ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+}
+
+// run runs a job, unless it was cancelled while queued.
+func (s *jobServer) run(j *job) {
+	j.lock.Lock()
+	if j.status != jobQueued {
+		j.lock.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	j.cancel = cancel
+	j.status = jobRunning
+	j.started = time.Now()
+	j.notify()
+	j.lock.Unlock()
+
+	s.log.info("job started", "id", j.id, "algorithm", j.config.algorithm(), "network", j.config.network_mode(), "nodes", j.config.node_num)
+	result, err := StartGossip(ctx, j.config)
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if err != nil {
+		result.err = err
+	}
+	j.result = new_job_result(result)
+	if j.status == jobRunning {
+		j.status = jobDone
+	}
+	j.finished = time.Now()
+	s.retire(j)
+	j.notify()
+	s.log.info("job finished", "id", j.id, "status", j.status, "converged", result.converged)
+}
+
+// submit queues a job for config, and returns it, or nil if the queue is full.
+func (s *jobServer) submit(config gossipConfig) *job {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	j := &job{
+		id:        s.next_id,
+		config:    config,
+		status:    jobQueued,
+		submitted: time.Now(),
+		changed:   make(chan struct{}),
+	}
+	j.config.observer = j.observe
+
+	select {
+	case s.queue <- j:
+	default:
+		return nil
+	}
+	s.jobs[j.id] = j
+	s.next_id += 1
+
+	return j
+}
+
+// cancel cancels a queued or running job, and returns false if it already
+// finished. A running job finishes once its worker notices.
+func (s *jobServer) cancel(j *job) bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	switch j.status {
+	case jobQueued:
+		j.finished = time.Now()
+		s.retire(j)
+	case jobRunning:
+		j.cancel()
+	default:
+		return false
+	}
+	j.status = jobCancelled
+	j.notify()
+
+	return true
+}
+
+// handler returns the HTTP handler of the server's API, with the metrics if
+// they are enabled.
+func (s *jobServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs", s.handle_jobs)
+	mux.HandleFunc("/jobs/", s.handle_job)
+	if m := current_metrics(); m != nil {
+		mux.Handle("/metrics", m)
+	}
+
+	return mux
+}
+
+// handle_jobs lists the jobs on GET, and submits one on POST.
+func (s *jobServer) handle_jobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.lock.Lock()
+		jobs := make([]*job, 0, len(s.jobs))
+		for _, j := range s.jobs {
+			jobs = append(jobs, j)
+		}
+		s.lock.Unlock()
+		sort.Slice(jobs, func(a, b int) bool { return jobs[a].id < jobs[b].id })
+
+		views := make([]jobView, len(jobs))
+		for i, j := range jobs {
+			j.lock.Lock()
+			views[i] = j.view()
+			views[i].Result = nil
+			j.lock.Unlock()
+		}
+		write_json(w, http.StatusOK, views)
+
+	case http.MethodPost:
+		var request jobRequest
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&request); err != nil {
+			write_error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		// Check the size before the configuration, whose node lists take
+		// memory for each node.
+		if request.Nodes > s.limits.max_nodes {
+			err := &ConfigError{"nodes", request.Nodes, fmt.Sprintf("need at most %d, the server's --max-nodes", s.limits.max_nodes), ErrInvalidOption}
+			write_error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		config, err := request.config()
+		if err != nil {
+			write_error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		j := s.submit(config)
+		if j == nil {
+			write_error(w, http.StatusServiceUnavailable, errors.New("the job queue is full"))
+			return
+		}
+		s.log.info("job submitted", "id", j.id)
+
+		j.lock.Lock()
+		view := j.view()
+		j.lock.Unlock()
+		w.Header().Set("Location", fmt.Sprintf("/jobs/%d", j.id))
+		write_json(w, http.StatusAccepted, view)
+
+	default:
+		write_error(w, http.StatusMethodNotAllowed, fmt.Errorf("%s is not allowed on /jobs", r.Method))
+	}
+}
+
+// handle_job shows a job on GET /jobs/{id}, cancels it on DELETE /jobs/{id},
+// and streams its progress on GET /jobs/{id}/progress.
+func (s *jobServer) handle_job(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+	id, err := strconv.Atoi(parts[0])
+	if err != nil || len(parts) > 2 || (len(parts) == 2 && parts[1] != "progress") {
+		write_error(w, http.StatusNotFound, fmt.Errorf("no such path %s", r.URL.Path))
+		return
+	}
+
+	s.lock.Lock()
+	j := s.jobs[id]
+	s.lock.Unlock()
+	if j == nil {
+		write_error(w, http.StatusNotFound, fmt.Errorf("no job %d", id))
+		return
+	}
+
+	switch {
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		s.stream(w, r, j)
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		j.lock.Lock()
+		view := j.view()
+		j.lock.Unlock()
+		write_json(w, http.StatusOK, view)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		if !s.cancel(j) {
+			write_error(w, http.StatusConflict, fmt.Errorf("job %d already finished", id))
+			return
+		}
+		s.log.info("job cancelled", "id", j.id)
+
+		j.lock.Lock()
+		view := j.view()
+		j.lock.Unlock()
+		write_json(w, http.StatusOK, view)
+	default:
+		write_error(w, http.StatusMethodNotAllowed, fmt.Errorf("%s is not allowed on %s", r.Method, r.URL.Path))
+	}
+}
+
+// stream writes the progress of a job as JSON lines, a line per round as the
+// rounds end, followed by the status of the job once it is over.
+func (s *jobServer) stream(w http.ResponseWriter, r *http.Request, j *job) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+
+	next := 0
+	for {
+		j.lock.Lock()
+		if next < j.skipped {
+			next = j.skipped
+		}
+		progress := j.progress[next-j.skipped:]
+		over := j.over() && j.result != nil || j.status == jobCancelled && j.started.IsZero()
+		view := j.view()
+		changed := j.changed
+		j.lock.Unlock()
+
+		for _, p := range progress {
+			if err := encoder.Encode(p); err != nil {
+				return
+			}
+		}
+		next += len(progress)
+
+		if over {
+			encoder.Encode(view)
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if over {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// write_json writes v as the JSON body of a response with status.
+func write_json(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// write_error writes err as the JSON body of a response with status, with the
+// option and reason of a *ConfigError.
+func write_error(w http.ResponseWriter, status int, err error) {
+	body := struct {
+		Error  string `json:"error"`
+		Option string `json:"option,omitempty"`
+		Reason string `json:"reason,omitempty"`
+	}{Error: err.Error()}
+
+	var config_err *ConfigError
+	if errors.As(err, &config_err) {
+		body.Option, body.Reason = config_err.Option, config_err.Reason
+	}
+	write_json(w, status, body)
+}
+
+// runServer serves the job API on addr, running at most workers jobs at a
+// time within limits, until ctx is done.
+func runServer(ctx context.Context, addr string, workers int, limits serverLimits) error {
+	switch {
+	case limits.queue < 1:
+		return &ConfigError{"--queue", limits.queue, "need at least 1", ErrInvalidOption}
+	case workers < 1:
+		return &ConfigError{"--workers", workers, "need at least 1", ErrInvalidOption}
+	case limits.retain < 1:
+		return &ConfigError{"--retain", limits.retain, "need at least 1", ErrInvalidOption}
+	case limits.max_nodes < 2:
+		return &ConfigError{"--max-nodes", limits.max_nodes, "need at least 2 nodes", ErrInvalidOption}
+	}
+
+	enable_metrics()
+	s := new_job_server(ctx, limits)
+	server := &http.Server{Addr: addr, Handler: s.handler()}
+	s.start(workers)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+	fmt.Printf("Serving the job API on http://%s with %d workers and a queue of %d\n", addr, workers, limits.queue)
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return server.Shutdown(shutdown)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestJobRequest(t *testing.T) {
+	config, err := jobRequest{Algorithm: "pushpull", Leader: true, Timeout: "1m"}.config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.node_num != 100 || config.infected_num != 1 || !config.should_push || !config.should_pull || config.network_mode() != "leader" {
+		t.Errorf("got %+v", config)
+	}
+
+	tests := []struct {
+		request jobRequest
+		err     error
+	}{
+		{jobRequest{}, ErrNoAlgorithm},
+		{jobRequest{Algorithm: "push", Nodes: 1}, ErrTooFewNodes},
+		{jobRequest{Algorithm: "push", Timeout: "soon"}, ErrInvalidOption},
+		{jobRequest{Algorithm: "push", Partition: "0.7;0.7", Heal: 2}, ErrInvalidOption},
+		{jobRequest{Algorithm: "push", Async: true, Leader: true}, ErrConflictingNetwork},
+	}
+	for _, test := range tests {
+		if _, err := test.request.config(); !errors.Is(err, test.err) {
+			t.Errorf("%+v: got %v, want %v", test.request, err, test.err)
+		}
+	}
+}
+
+// post submits a job to the server at url, and returns the response status
+// and its decoded body.
+func post(t *testing.T, url string, body string) (int, map[string]interface{}) {
+	t.Helper()
+
+	response, err := http.Post(url+"/jobs", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	var decoded map[string]interface{}
+	if err := json.NewDecoder(response.Body).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	return response.StatusCode, decoded
+}
+
+// request sends a request without a body to the server, and returns the
+// response status.
+func request(t *testing.T, method string, url string) int {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	return response.StatusCode
+}
+
+// TestServer submits a job, follows its progress to the end and checks its
+// result.
+func TestServer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := new_job_server(ctx, serverLimits{queue: 4, retain: 4, max_nodes: 1000})
+	s.start(1)
+	server := httptest.NewServer(s.handler())
+	defer server.Close()
+
+	status, body := post(t, server.URL, `{"algorithm": "pushpull", "nodes": 256, "leader": true, "seed": 1}`)
+	if status != http.StatusAccepted || body["id"] != 1.0 {
+		t.Fatalf("got %d %v", status, body)
+	}
+
+	response, err := http.Get(server.URL + "/jobs/1/progress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) < 2 {
+		t.Fatalf("got progress %v", lines)
+	}
+
+	var end jobView
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &end); err != nil {
+		t.Fatal(err)
+	}
+	if end.Status != jobDone || end.Result == nil || !end.Result.Converged || end.Result.Infected != 256 {
+		t.Fatalf("got end %s", lines[len(lines)-1])
+	}
+	if len(lines)-1 != end.Result.Rounds {
+		t.Errorf("got %d progress lines for %d rounds", len(lines)-1, end.Result.Rounds)
+	}
+
+	var last jobProgress
+	if err := json.Unmarshal([]byte(lines[len(lines)-2]), &last); err != nil {
+		t.Fatal(err)
+	}
+	if last.Round != end.Result.Rounds || last.Infected != 256 || last.Messages != end.Result.Messages {
+		t.Errorf("got last progress %+v for result %+v", last, end.Result)
+	}
+
+	if status := request(t, http.MethodDelete, server.URL+"/jobs/1"); status != http.StatusConflict {
+		t.Errorf("cancelling a finished job: got %d, want 409", status)
+	}
+	if status := request(t, http.MethodGet, server.URL+"/jobs/2"); status != http.StatusNotFound {
+		t.Errorf("getting a missing job: got %d, want 404", status)
+	}
+
+	status, body = post(t, server.URL, `{"algorithm": "push", "nodes": 1}`)
+	if status != http.StatusBadRequest || body["option"] != "-n" {
+		t.Errorf("submitting an invalid job: got %d %v", status, body)
+	}
+}
+
+// TestServerQueue checks that the server turns jobs away when its queue is
+// full, and that a queued job can be cancelled.
+func TestServerQueue(t *testing.T) {
+	s := new_job_server(context.Background(), serverLimits{queue: 1, retain: 4, max_nodes: 1000})
+	server := httptest.NewServer(s.handler())
+	defer server.Close()
+
+	job := `{"algorithm": "push", "nodes": 16}`
+	if status, _ := post(t, server.URL, job); status != http.StatusAccepted {
+		t.Fatalf("got %d, want 202", status)
+	}
+	if status, _ := post(t, server.URL, job); status != http.StatusServiceUnavailable {
+		t.Errorf("got %d, want 503 with a full queue", status)
+	}
+
+	if status := request(t, http.MethodDelete, server.URL+"/jobs/1"); status != http.StatusOK {
+		t.Errorf("cancelling a queued job: got %d, want 200", status)
+	}
+
+	response, err := http.Get(server.URL + "/jobs/1/progress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	var end jobView
+	if err := json.NewDecoder(response.Body).Decode(&end); err != nil {
+		t.Fatal(err)
+	}
+	if end.Status != jobCancelled || end.Started != nil {
+		t.Errorf("got %+v, want a cancelled job that never started", end)
+	}
+}
+
+// TestServerLimits checks that the server forgets the oldest finished jobs
+// beyond the number to retain, turns away jobs with too many nodes, and keeps
+// only the last rounds of progress.
+func TestServerLimits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := new_job_server(ctx, serverLimits{queue: 4, retain: 1, max_nodes: 1000})
+	s.start(1)
+	server := httptest.NewServer(s.handler())
+	defer server.Close()
+
+	for id := 1; id <= 2; id++ {
+		if status, _ := post(t, server.URL, `{"algorithm": "push", "nodes": 16, "leader": true}`); status != http.StatusAccepted {
+			t.Fatalf("job %d: got %d, want 202", id, status)
+		}
+		response, err := http.Get(fmt.Sprintf("%s/jobs/%d/progress", server.URL, id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(response.Body)
+		response.Body.Close()
+	}
+	if status := request(t, http.MethodGet, server.URL+"/jobs/1"); status != http.StatusNotFound {
+		t.Errorf("getting a forgotten job: got %d, want 404", status)
+	}
+	if status := request(t, http.MethodGet, server.URL+"/jobs/2"); status != http.StatusOK {
+		t.Errorf("getting the last job: got %d, want 200", status)
+	}
+
+	status, body := post(t, server.URL, `{"algorithm": "push", "nodes": 2000000000, "partition": "0-1999999999;0"}`)
+	if status != http.StatusBadRequest || body["option"] != "nodes" {
+		t.Errorf("submitting too many nodes: got %d %v", status, body)
+	}
+
+	j := &job{changed: make(chan struct{})}
+	for round := 1; round <= jobProgressLimit+10; round++ {
+		j.observe(&Network{}, round)
+	}
+	if len(j.progress) != jobProgressLimit || j.skipped != 10 || j.progress[0].Round != 11 {
+		t.Errorf("kept %d rounds from round %d, skipping %d", len(j.progress), j.progress[0].Round, j.skipped)
+	}
+}
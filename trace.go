@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The kinds of events in a trace.
+const (
+	traceConfig  = "config"  // The configuration of the run. Always the first event.
+	traceSend    = "send"    // A node sent a message.
+	traceReceive = "receive" // A node received a message.
+	traceInfect  = "infect"  // A node became infected.
+	traceDrop    = "drop"    // A message between groups of a partition was lost.
+	tracePhase   = "phase"   // A phase started, or a round ended.
+	traceEnd     = "end"     // The run finished. Always the last event.
+)
+
+// The types of messages in send and receive events.
+const (
+	tracePush    = "push"    // An infection status pushed to another node.
+	traceRequest = "request" // A pull request.
+	traceReply   = "reply"   // The infection status answering a pull request.
+)
+
+// traceEvent is a single line of a trace file. Node positions that do not
+// apply to the event are -1.
+type traceEvent struct {
+	Seq   int64   `json:"seq"`            // The order in which the event was recorded.
+	Kind  string  `json:"kind"`           // The kind of event.
+	Round int     `json:"round"`          // The round of the node recording the event.
+	Time  int64   `json:"ns"`             // Nanoseconds since the start of the gossip.
+	Sim   float64 `json:"sim"`            // The simulated time: the time in the Poisson model, or else the round.
+	From  int     `json:"from"`           // The sending or infecting node.
+	To    int     `json:"to"`             // The receiving or infected node.
+	Type  string  `json:"type,omitempty"` // The message type, or the phase name.
+
+	Nodes     int    `json:"nodes,omitempty"`     // Config: the number of nodes.
+	Infected  int    `json:"infected,omitempty"`  // Config: the initially infected nodes. End: the infected nodes.
+	Algorithm string `json:"algorithm,omitempty"` // Config: push, pull, pushpull or median.
+	Network   string `json:"network,omitempty"`   // Config: async, sync or leader.
+}
+
+// tracer records events to a JSON lines file. Events are numbered under a
+// lock, so the sequence gives a total order across goroutines.
+type tracer struct {
+	file  *os.File
+	w     *bufio.Writer
+	enc   *json.Encoder
+	seq   int64
+	start time.Time
+	err   error // The first error writing an event, returned by Close.
+	lock  sync.Mutex
+}
+
+// new_tracer creates a tracer writing to path.
+func new_tracer(path string) (*tracer, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriter(file)
+	return &tracer{file: file, w: w, enc: json.NewEncoder(w), start: time.Now()}, nil
+}
+
+// record writes an event, filling in its sequence number and time. After an
+// error, it writes nothing more.
+func (t *tracer) record(e traceEvent) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.err != nil {
+		return
+	}
+	t.seq += 1
+	e.Seq = t.seq
+	e.Time = int64(time.Since(t.start))
+	t.err = t.enc.Encode(e)
+}
+
+// begin records the configuration of a run, and restarts the clock.
+func (t *tracer) begin(config gossipConfig) {
+	t.lock.Lock()
+	t.start = time.Now()
+	t.lock.Unlock()
+
+	t.record(traceEvent{
+		Kind:      traceConfig,
+		From:      -1,
+		To:        -1,
+		Nodes:     config.node_num,
+		Infected:  config.infected_num,
+		Algorithm: config.algorithm(),
+		Network:   config.network_mode(),
+	})
+}
+
+// Close flushes the trace and closes the file. It returns the first error
+// writing an event, if any.
+func (t *tracer) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.err == nil {
+		t.err = t.w.Flush()
+	}
+	if err := t.file.Close(); t.err == nil {
+		t.err = err
+	}
+
+	return t.err
+}
+
+// trace records an event if the network is being traced.
+func (n *Network) trace(kind string, round int, from int, to int, typ string) {
+	if n.tracer != nil {
+		sim := float64(round)
+		if n.sim_time != nil {
+			sim = *n.sim_time
+		}
+		n.tracer.record(traceEvent{Kind: kind, Round: round, Sim: sim, From: from, To: to, Type: typ})
+	}
+}
+
+// trace_phase records a phase boundary. Without a leader, only the first node
+// records phases, since all nodes run them in step.
+func (n *Node) trace_phase(phase string) {
+	if n.network.has_leader || n.node_pos == 0 {
+		n.network.trace(tracePhase, n.current_round(), -1, -1, phase)
+	}
+}
+
+// read_trace reads all events of a trace file.
+func read_trace(r io.Reader) ([]traceEvent, error) {
+	events := []traceEvent{}
+	dec := json.NewDecoder(r)
+
+	for {
+		var e traceEvent
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("event %d: %v", len(events)+1, err)
+		}
+		events = append(events, e)
+	}
+
+	if len(events) == 0 || events[0].Kind != traceConfig {
+		return nil, fmt.Errorf("trace does not start with a config event")
+	}
+
+	sort.Slice(events, func(i, j int) bool { return events[i].Seq < events[j].Seq })
+	return events, nil
+}
+
+// replayRound is the reconstructed activity in a single round.
+type replayRound struct {
+	round      int
+	sends      map[string]int // The number of messages sent of each type.
+	receives   int
+	infections int
+	infected   int // The number of infected nodes at the end of the round.
+	events     []traceEvent
+}
+
+// replay_trace reconstructs the progress of a run from its events, round by
+// round. The infected node count is rebuilt from the initially infected nodes
+// and the infect events.
+func replay_trace(events []traceEvent) []replayRound {
+	config := events[0]
+	infected := make([]bool, config.Nodes)
+	count := 0
+	for i := 0; i < config.Infected && i < config.Nodes; i++ {
+		infected[i] = true
+		count += 1
+	}
+
+	rounds := []replayRound{}
+	by_round := map[int]int{}
+	for _, e := range events[1:] {
+		if e.Kind == traceEnd {
+			continue
+		}
+
+		idx, ok := by_round[e.Round]
+		if !ok {
+			idx = len(rounds)
+			by_round[e.Round] = idx
+			rounds = append(rounds, replayRound{round: e.Round, sends: map[string]int{}})
+		}
+		r := &rounds[idx]
+		r.events = append(r.events, e)
+
+		switch e.Kind {
+		case traceSend:
+			r.sends[e.Type] += 1
+		case traceReceive:
+			r.receives += 1
+		case traceInfect:
+			if e.To >= 0 && e.To < len(infected) && !infected[e.To] {
+				infected[e.To] = true
+				r.infections += 1
+			}
+		}
+	}
+
+	sort.Slice(rounds, func(i, j int) bool { return rounds[i].round < rounds[j].round })
+	for i := range rounds {
+		count += rounds[i].infections
+		rounds[i].infected = count
+	}
+
+	return rounds
+}
+
+// format_event describes an event in a single line, for stepping through a
+// replay.
+func format_event(e traceEvent) string {
+	at := time.Duration(e.Time)
+	switch e.Kind {
+	case traceSend:
+		return fmt.Sprintf("%10v  %d -> %d %s", at, e.From, e.To, e.Type)
+	case traceReceive:
+		return fmt.Sprintf("%10v  %d <- %d %s", at, e.To, e.From, e.Type)
+	case traceInfect:
+		return fmt.Sprintf("%10v  %d infected by %d (%s)", at, e.To, e.From, e.Type)
+	case traceDrop:
+		return fmt.Sprintf("%10v  %d -> %d %s dropped", at, e.From, e.To, e.Type)
+	case tracePhase:
+		return fmt.Sprintf("%10v  -- %s --", at, e.Type)
+	}
+
+	return fmt.Sprintf("%10v  %s", at, e.Kind)
+}
@@ -0,0 +1,85 @@
+package main
+
+import "testing"
+
+// TestHops checks that in every mode that records infections, each node is one
+// hop further from the initially infected nodes than the node that infected
+// it.
+func TestHops(t *testing.T) {
+	modes := []gossipConfig{{leader: true}, {}, {async: true}, {engine: enginePool}, {poisson_rate: 1}}
+	for _, mode := range modes {
+		config := test_config(mode, true, true)
+		config.infected_num = 2
+
+		result := run_config(t, mode.network_mode(), config, nil)
+		for pos, r := range result.infections {
+			want := 0
+			if r.from >= 0 {
+				want = result.infections[r.from].hops + 1
+			}
+			if r.infected && r.hops != want {
+				t.Errorf("%s: node %d took %d hops, want %d", mode.network_mode(), pos, r.hops, want)
+			}
+		}
+	}
+}
+
+// TestTTL checks that with a TTL of 1 and a maximum age of 2 rounds, only the
+// initially infected node forwards the rumor, for 2 rounds, after which every
+// mode stops with ErrStoppedSpreading, the synchronous ones after 2 rounds.
+func TestTTL(t *testing.T) {
+	for _, mode := range testModes[:4] {
+		config := mode.config(true, false)
+		config.ttl, config.max_age = 1, 2
+
+		result := run_config(t, mode.name, config, ErrStoppedSpreading)
+		if result.infected < 1 || result.infected > 3 {
+			t.Errorf("%s: %d nodes infected, want 1 to 3", mode.name, result.infected)
+		}
+		if total := result.total_messages(); total > 2 {
+			t.Errorf("%s: sent %d messages, want at most 2", mode.name, total)
+		}
+		if !mode.async && result.rounds != 2 {
+			t.Errorf("%s: completed %d rounds, want 2", mode.name, result.rounds)
+		}
+	}
+}
+
+// TestTTLWithoutMaxAge checks that a TTL alone bounds the flood: with a TTL
+// of 1, only the initially infected node forwards the rumor, for the default
+// maximum age, after which every mode stops with ErrStoppedSpreading, the
+// synchronous ones right then.
+func TestTTLWithoutMaxAge(t *testing.T) {
+	for _, mode := range testModes[:4] {
+		config := mode.config(true, true)
+		config.ttl = 1
+
+		result := run_config(t, mode.name, config, ErrStoppedSpreading)
+		if result.infected >= testNodes/2 {
+			t.Errorf("%s: %d nodes infected by a single forwarding node", mode.name, result.infected)
+		}
+		if !mode.async && result.rounds != default_max_age(testNodes) {
+			t.Errorf("%s: completed %d rounds, want %d", mode.name, result.rounds, default_max_age(testNodes))
+		}
+	}
+}
+
+// TestMaxAge checks that with a leader, nodes forward the rumor only in the
+// round after they got it when the maximum age is 1, so each round's pushes
+// are the previous round's new infections.
+func TestMaxAge(t *testing.T) {
+	config := testModes[0].config(true, false)
+	config.infected_num, config.max_age = 4, 1
+
+	result := run_config(t, "leader", config, ErrStoppedSpreading)
+
+	for round := 1; round < len(result.curve); round++ {
+		want := int64(result.curve[round-1])
+		if round > 1 {
+			want -= int64(result.curve[round-2])
+		}
+		if got := result.messages[round-1]; got != want {
+			t.Errorf("%d messages in round %d, want %d", got, round, want)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dashboardWidth    = 60                    // The width of the progress bar and sparkline.
+	dashboardMapNodes = 1024                  // The largest network to draw a node map for.
+	dashboardInterval = 50 * time.Millisecond // The minimum time between redraws.
+)
+
+// sparkChars are the block characters used to draw the sparkline, from lowest
+// to highest.
+var sparkChars = []rune("▁▂▃▄▅▆▇█")
+
+// dashboard renders the progress of a running simulation in place, using ANSI
+// escape codes to redraw over its previous output.
+type dashboard struct {
+	out       io.Writer
+	node_num  int
+	curve     []int     // The number of infected nodes after each round.
+	messages  []int64   // The number of messages sent in each round.
+	last_sent int64     // The total number of messages sent by the last round.
+	last_draw time.Time // When the dashboard was last drawn.
+	lines     int       // The number of lines drawn last time.
+	lock      sync.Mutex
+}
+
+// new_dashboard creates a dashboard for a network of node_num nodes, drawn to
+// out.
+func new_dashboard(out io.Writer, node_num int) *dashboard {
+	return &dashboard{out: out, node_num: node_num}
+}
+
+// observe records the state of the network at the end of a round, and redraws
+// the dashboard if enough time has passed. It can be used as a RoundObserver.
+func (d *dashboard) observe(n *Network, round int) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	infected := n.infected_count()
+	sent := n.message_count()
+	d.curve = append(d.curve, infected)
+	d.messages = append(d.messages, sent-d.last_sent)
+	d.last_sent = sent
+
+	if infected < d.node_num && time.Since(d.last_draw) < dashboardInterval {
+		return
+	}
+
+	d.draw(n, round, infected)
+	d.last_draw = time.Now()
+}
+
+// draw renders the dashboard over the previous one.
+func (d *dashboard) draw(n *Network, round int, infected int) {
+	var b strings.Builder
+
+	if d.lines > 0 {
+		fmt.Fprintf(&b, "\x1b[%dA", d.lines)
+	}
+	b.WriteString("\x1b[J")
+
+	fraction := float64(infected) / float64(d.node_num)
+	filled := int(fraction * dashboardWidth)
+	fmt.Fprintf(&b, "Round %d\n", round)
+	fmt.Fprintf(&b, "[%s%s] %5.1f%% %d/%d infected\n",
+		strings.Repeat("#", filled), strings.Repeat(".", dashboardWidth-filled), 100*fraction, infected, d.node_num)
+	fmt.Fprintf(&b, "Messages this round: %d, total: %d\n", d.messages[len(d.messages)-1], d.last_sent)
+	fmt.Fprintf(&b, "Infected %s\n", sparkline(d.curve, d.node_num, dashboardWidth))
+
+	if d.node_num <= dashboardMapNodes {
+		b.WriteString(node_map(n, d.node_num))
+	}
+
+	out := b.String()
+	d.lines = strings.Count(out, "\n")
+	fmt.Fprint(d.out, out)
+}
+
+// sparkline draws values between 0 and max as at most width block characters.
+// If there are more values than fit, each character shows the largest value of
+// the values it covers.
+func sparkline(values []int, max int, width int) string {
+	if len(values) == 0 || max <= 0 {
+		return ""
+	}
+
+	buckets := len(values)
+	if buckets > width {
+		buckets = width
+	}
+
+	line := make([]rune, buckets)
+	for i := range line {
+		lo := i * len(values) / buckets
+		hi := (i + 1) * len(values) / buckets
+
+		peak := 0
+		for _, v := range values[lo:hi] {
+			if v > peak {
+				peak = v
+			}
+		}
+
+		level := peak * (len(sparkChars) - 1) / max
+		line[i] = sparkChars[level]
+	}
+
+	return string(line)
+}
+
+// node_map draws each node as a character in a square grid, in order of
+// position: '#' if infected, and '.' otherwise.
+func node_map(n *Network, node_num int) string {
+	var b strings.Builder
+
+	cols := int(math.Ceil(math.Sqrt(float64(node_num))))
+	for pos := 0; pos < node_num; pos++ {
+		if n.is_infected(pos) {
+			b.WriteByte('#')
+		} else {
+			b.WriteByte('.')
+		}
+
+		if (pos+1)%cols == 0 || pos == node_num-1 {
+			b.WriteByte('\n')
+		}
+	}
+
+	return b.String()
+}